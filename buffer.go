@@ -0,0 +1,288 @@
+package knot
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/luisfelipemisi/knot/integration/knot/fileutil"
+)
+
+// Defaults used when the reading buffer is not configured
+const (
+	defaultBufferDir   = "internal/config/buffer"
+	defaultMaxReadings = 10000
+	defaultMaxAge      = 7 * 24 * time.Hour
+
+	// replayBatch is how many buffered readings are sent on each message
+	replayBatch = 100
+
+	bufferFileExt = ".jsonl"
+)
+
+// timestampLayouts are the layouts accepted on reading timestamps
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// bufferedReading is a reading kept on disk while it cannot be published
+type bufferedReading struct {
+	Data       entities.Data `json:"data"`
+	BufferedAt time.Time     `json:"bufferedAt"`
+}
+
+// readingBuffer keeps a file per device with the readings that could not
+// be published, so they are sent once the device is publishing again
+type readingBuffer struct {
+	dir         string
+	maxReadings int
+	maxAge      time.Duration
+	counts      map[string]int
+}
+
+func newReadingBuffer(conf entities.BufferConfig) (*readingBuffer, error) {
+	b := &readingBuffer{
+		dir:         conf.Dir,
+		maxReadings: conf.MaxReadings,
+		maxAge:      entities.Seconds(conf.MaxAgeInSeconds, defaultMaxAge),
+		counts:      make(map[string]int),
+	}
+	if b.dir == "" {
+		b.dir = defaultBufferDir
+	}
+	if b.maxReadings <= 0 {
+		b.maxReadings = defaultMaxReadings
+	}
+
+	err := os.MkdirAll(b.dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating buffer directory: %w", err)
+	}
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading buffer directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != bufferFileExt {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), bufferFileExt)
+		readings, err := b.load(id)
+		if err != nil {
+			return nil, err
+		}
+		b.counts[id] = len(readings)
+	}
+	return b, nil
+}
+
+// pending reports if the device has buffered readings
+func (b *readingBuffer) pending(deviceID string) bool {
+	return b.counts[deviceID] > 0
+}
+
+// add appends the readings to the device buffer, dropping the oldest ones
+// when it is full
+func (b *readingBuffer) add(deviceID string, data []entities.Data) error {
+	if len(data) == 0 {
+		return nil
+	}
+	now := time.Now()
+	readings := make([]bufferedReading, 0, len(data))
+	for _, reading := range data {
+		readings = append(readings, bufferedReading{Data: reading, BufferedAt: now})
+	}
+
+	if b.counts[deviceID]+len(readings) > b.maxReadings {
+		stored, err := b.load(deviceID)
+		if err != nil {
+			return err
+		}
+		readings = append(stored, readings...)
+		if dropped := len(readings) - b.maxReadings; dropped > 0 {
+			readings = readings[dropped:]
+		}
+		return b.write(deviceID, readings)
+	}
+
+	file, err := os.OpenFile(b.path(deviceID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening buffer of device %s: %w", deviceID, err)
+	}
+	defer file.Close()
+
+	err = encodeReadings(file, readings)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("error buffering readings of device %s: %w", deviceID, err)
+	}
+	b.counts[deviceID] += len(readings)
+	return nil
+}
+
+// replay sends the buffered readings together with the new ones in
+// timestamp order. Readings not sent stay on the buffer.
+func (b *readingBuffer) replay(deviceID string, data []entities.Data, send func([]entities.Data) error) error {
+	readings, err := b.load(deviceID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, reading := range data {
+		readings = append(readings, bufferedReading{Data: reading, BufferedAt: now})
+	}
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readingTime(readings[i]).Before(readingTime(readings[j]))
+	})
+
+	for len(readings) > 0 {
+		size := replayBatch
+		if len(readings) < size {
+			size = len(readings)
+		}
+		batch := make([]entities.Data, 0, size)
+		for _, reading := range readings[:size] {
+			batch = append(batch, reading.Data)
+		}
+
+		err = send(batch)
+		if err != nil {
+			if writeErr := b.write(deviceID, readings); writeErr != nil {
+				return writeErr
+			}
+			return err
+		}
+		readings = readings[size:]
+	}
+	return b.clear(deviceID)
+}
+
+// rename moves the buffer when the device gets a new ID
+func (b *readingBuffer) rename(oldID, newID string) error {
+	if !b.pending(oldID) {
+		return nil
+	}
+	err := os.Rename(b.path(oldID), b.path(newID))
+	if err != nil {
+		return fmt.Errorf("error moving buffer of device %s: %w", oldID, err)
+	}
+	b.counts[newID] = b.counts[oldID]
+	delete(b.counts, oldID)
+	return nil
+}
+
+// clear drops the buffered readings of the device
+func (b *readingBuffer) clear(deviceID string) error {
+	delete(b.counts, deviceID)
+	err := os.Remove(b.path(deviceID))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing buffer of device %s: %w", deviceID, err)
+	}
+	return nil
+}
+
+// load reads the device buffer, dropping the readings older than the max age
+func (b *readingBuffer) load(deviceID string) ([]bufferedReading, error) {
+	file, err := os.Open(b.path(deviceID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening buffer of device %s: %w", deviceID, err)
+	}
+	defer file.Close()
+
+	readings := []bufferedReading{}
+	oldest := time.Now().Add(-b.maxAge)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		reading := bufferedReading{}
+		// A line cut by a crash is skipped
+		if json.Unmarshal(scanner.Bytes(), &reading) != nil {
+			continue
+		}
+		if reading.BufferedAt.Before(oldest) {
+			continue
+		}
+		readings = append(readings, reading)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading buffer of device %s: %w", deviceID, err)
+	}
+	return readings, nil
+}
+
+// write replaces the device buffer with the given readings
+func (b *readingBuffer) write(deviceID string, readings []bufferedReading) error {
+	if len(readings) == 0 {
+		return b.clear(deviceID)
+	}
+
+	var content strings.Builder
+	err := encodeReadings(&content, readings)
+	if err != nil {
+		return fmt.Errorf("error encoding buffer of device %s: %w", deviceID, err)
+	}
+	err = fileutil.WriteAtomic(b.path(deviceID), []byte(content.String()))
+	if err != nil {
+		return err
+	}
+	b.counts[deviceID] = len(readings)
+	return nil
+}
+
+func (b *readingBuffer) path(deviceID string) string {
+	return filepath.Join(b.dir, filepath.Base(deviceID)+bufferFileExt)
+}
+
+func encodeReadings(w io.Writer, readings []bufferedReading) error {
+	encoder := json.NewEncoder(w)
+	for _, reading := range readings {
+		err := encoder.Encode(reading)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readingTime orders the readings by their timestamp, falling back to the
+// time they were buffered
+func readingTime(reading bufferedReading) time.Time {
+	if t, ok := parseTimestamp(reading.Data.TimeStamp); ok {
+		return t
+	}
+	return reading.BufferedAt
+}
+
+// parseTimestamp reads a timestamp given as text or as unix seconds
+func parseTimestamp(timestamp interface{}) (time.Time, bool) {
+	switch value := timestamp.(type) {
+	case time.Time:
+		return value, true
+	case string:
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, true
+			}
+		}
+	case float64:
+		return time.Unix(0, int64(value*float64(time.Second))), true
+	case int64:
+		return time.Unix(value, 0), true
+	case int:
+		return time.Unix(int64(value), 0), true
+	}
+	return time.Time{}, false
+}
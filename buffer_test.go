@@ -0,0 +1,194 @@
+package knot
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// bufferReadings builds readings of sensor 1 valued from first on, one
+// second apart
+func bufferReadings(first, count int) []entities.Data {
+	start := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	data := make([]entities.Data, 0, count)
+	for i := first; i < first+count; i++ {
+		data = append(data, entities.Data{
+			SensorID:  1,
+			Value:     float64(i),
+			TimeStamp: start.Add(time.Duration(i) * time.Second).Format(time.RFC3339),
+		})
+	}
+	return data
+}
+
+// values lists the values of the readings
+func values(data []entities.Data) []float64 {
+	list := make([]float64, 0, len(data))
+	for _, reading := range data {
+		number, _ := entities.ToFloat(reading.Value)
+		list = append(list, number)
+	}
+	return list
+}
+
+func TestReadingBufferReplay(t *testing.T) {
+	buffer, err := newReadingBuffer(entities.BufferConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Readings arrive out of order and are replayed by timestamp
+	if err = buffer.add("device", bufferReadings(50, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err = buffer.add("device", bufferReadings(0, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if !buffer.pending("device") || buffer.pending("other") {
+		t.Fatal("pending does not follow the readings buffered")
+	}
+
+	var batches [][]float64
+	err = buffer.replay("device", bufferReadings(150, 10), func(data []entities.Data) error {
+		batches = append(batches, values(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 2 || len(batches[0]) != replayBatch || len(batches[1]) != 60 {
+		t.Fatalf("sent %d batches, want one of %d and one of 60", len(batches), replayBatch)
+	}
+	sent := append(batches[0], batches[1]...)
+	for i, value := range sent {
+		if value != float64(i) {
+			t.Fatalf("reading %d sent is %v, want the readings in timestamp order", i, value)
+		}
+	}
+	if buffer.pending("device") {
+		t.Error("readings still pending after a replay")
+	}
+	if _, err := os.Stat(buffer.path("device")); !os.IsNotExist(err) {
+		t.Errorf("buffer file kept after a replay: %v", err)
+	}
+}
+
+func TestReadingBufferReplayKeepsUnsent(t *testing.T) {
+	dir := t.TempDir()
+	buffer, err := newReadingBuffer(entities.BufferConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = buffer.add("device", bufferReadings(0, 150)); err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("connection lost")
+	calls := 0
+	err = buffer.replay("device", nil, func(data []entities.Data) error {
+		calls++
+		if calls == 2 {
+			return failure
+		}
+		return nil
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("replay() = %v, want the send error", err)
+	}
+
+	// A new buffer on the same directory finds the readings not sent
+	buffer, err = newReadingBuffer(entities.BufferConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readings, err := buffer.load("device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 50 || buffer.counts["device"] != 50 {
+		t.Fatalf("kept %d readings, want the last 50", len(readings))
+	}
+	if number, _ := entities.ToFloat(readings[0].Data.Value); number != replayBatch {
+		t.Errorf("first reading kept is %v, want %d", number, replayBatch)
+	}
+}
+
+func TestReadingBufferDropsOldest(t *testing.T) {
+	buffer, err := newReadingBuffer(entities.BufferConfig{Dir: t.TempDir(), MaxReadings: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for first := 0; first < 25; first += 5 {
+		if err = buffer.add("device", bufferReadings(first, 5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readings, err := buffer.load("device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 10 || buffer.counts["device"] != 10 {
+		t.Fatalf("kept %d readings, want 10", len(readings))
+	}
+	if number, _ := entities.ToFloat(readings[0].Data.Value); number != 15 {
+		t.Errorf("oldest reading kept is %v, want 15", number)
+	}
+}
+
+func TestReadingBufferLoadSkipsExpiredAndBroken(t *testing.T) {
+	buffer, err := newReadingBuffer(entities.BufferConfig{Dir: t.TempDir(), MaxAgeInSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := bufferedReading{Data: bufferReadings(0, 1)[0], BufferedAt: time.Now().Add(-time.Hour)}
+	fresh := bufferedReading{Data: bufferReadings(1, 1)[0], BufferedAt: time.Now()}
+	if err = buffer.write("device", []bufferedReading{old, fresh}); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(buffer.path("device"), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteString(`{"data":{"sensorId":1,`)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readings, err := buffer.load("device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 1 {
+		t.Fatalf("loaded %d readings, want only the fresh one", len(readings))
+	}
+	if number, _ := entities.ToFloat(readings[0].Data.Value); number != 1 {
+		t.Errorf("loaded reading %v, want 1", number)
+	}
+}
+
+func TestReadingBufferRename(t *testing.T) {
+	buffer, err := newReadingBuffer(entities.BufferConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = buffer.add("old", bufferReadings(0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err = buffer.rename("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.pending("old") || !buffer.pending("new") {
+		t.Fatal("readings did not follow the new ID")
+	}
+	readings, err := buffer.load("new")
+	if err != nil || len(readings) != 3 {
+		t.Errorf("loaded %d readings of the new ID (%v), want 3", len(readings), err)
+	}
+	if err = buffer.rename("none", "other"); err != nil {
+		t.Errorf("rename() of a device with no readings = %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package knot
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/luisfelipemisi/knot/integration/knot/network"
+	"github.com/sirupsen/logrus"
+)
+
+// CommandHandler answers the commands Knot Cloud sends to the devices. The
+// methods run outside the control routine, so they may block on the source.
+type CommandHandler interface {
+	// HandleDataRequest returns the current readings of the sensors
+	HandleDataRequest(deviceID string, sensorIDs []int) ([]entities.Data, error)
+	// HandleDataUpdate writes the values to the sensors and returns the
+	// readings confirmed by the source
+	HandleDataUpdate(deviceID string, data []entities.Data) ([]entities.Data, error)
+}
+
+// cloudCommand is a command received from Knot Cloud for a device
+type cloudCommand struct {
+	deviceID  string
+	command   string
+	sensorIDs []int
+	data      []entities.Data
+}
+
+// commandReply carries the readings answering a cloud command
+type commandReply struct {
+	deviceID string
+	data     []entities.Data
+}
+
+// Decode the command sent to a device, reporting false for other messages
+func parseCloudCommand(message network.InMsg, log *logrus.Entry) (cloudCommand, bool) {
+	deviceID, command, ok := network.ParseCommandKey(message.RoutingKey)
+	if !ok {
+		return cloudCommand{}, false
+	}
+
+	cmd := cloudCommand{deviceID: deviceID, command: command}
+	switch command {
+	case network.CommandDataRequest:
+		request := network.DataRequest{}
+		if err := json.Unmarshal(message.Body, &request); err != nil {
+			log.Errorln(err)
+			return cloudCommand{}, false
+		}
+		cmd.sensorIDs = request.SensorIds
+	case network.CommandDataUpdate:
+		update := network.DataUpdate{}
+		if err := json.Unmarshal(message.Body, &update); err != nil {
+			log.Errorln(err)
+			return cloudCommand{}, false
+		}
+		cmd.data = update.Data
+	}
+	return cmd, true
+}
+
+// Send the command to the control routine unless the protocol is closing
+func sendCloudCommand(ctx context.Context, cloudCommands chan cloudCommand, command cloudCommand) {
+	select {
+	case cloudCommands <- command:
+	case <-ctx.Done():
+	}
+}
+
+// Set the handler of the commands sent by Knot Cloud
+func (p *protocol) setCommandHandler(handler CommandHandler) {
+	p.handlerMu.Lock()
+	defer p.handlerMu.Unlock()
+	p.handler = handler
+}
+
+func (p *protocol) commandHandler() CommandHandler {
+	p.handlerMu.Lock()
+	defer p.handlerMu.Unlock()
+	return p.handler
+}
+
+// Run the handler of a cloud command outside the control routine, the
+// readings it returns come back as a reply
+func (p *protocol) handleCloudCommand(command cloudCommand) {
+	device, ok := p.registry.Get(command.deviceID)
+	if !ok || device.State != entities.KnotPublishing {
+		p.log.Printf("dropped a %s command of device %s not publishing", command.command, command.deviceID)
+		return
+	}
+	handler := p.commandHandler()
+	if handler == nil {
+		p.log.Printf("dropped a %s command of device %s with no handler", command.command, command.deviceID)
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		var data []entities.Data
+		var err error
+		if command.command == network.CommandDataRequest {
+			data, err = handler.HandleDataRequest(command.deviceID, command.sensorIDs)
+		} else {
+			data, err = handler.HandleDataUpdate(command.deviceID, command.data)
+		}
+		// Readings confirmed before a failure are still published
+		if err != nil {
+			p.log.Errorf("%s command of device %s: %v", command.command, command.deviceID, err)
+		}
+		if len(data) == 0 {
+			return
+		}
+
+		select {
+		case p.commandReplies <- commandReply{deviceID: command.deviceID, data: data}:
+		case <-p.ctx.Done():
+		}
+	}()
+}
+
+// Publish the readings answering a command. They skip the sensor events,
+// since Knot Cloud asked for them.
+func (p *protocol) publishReply(reply commandReply) {
+	device, ok := p.registry.Get(reply.deviceID)
+	if !ok || len(reply.data) == 0 {
+		return
+	}
+	device.Data = reply.data
+	data := p.validData(device)
+	if device.State != entities.KnotPublishing {
+		verifyErrors(p.buffer.add(device.ID, data), p.log)
+		return
+	}
+	p.sendData(device, data)
+}
+
+// Receive the commands sent to the device while it is publishing
+func (p *protocol) subscribeCommands(deviceID string) {
+	if p.bindings[deviceID] {
+		return
+	}
+	err := p.network.subscriber.SubscribeToDeviceCommands(deviceID)
+	if err != nil {
+		p.log.Errorf("error subscribing to commands of device %s: %v", deviceID, err)
+		return
+	}
+	p.bindings[deviceID] = true
+}
+
+// Stop receiving the commands of a device removed or given a new ID
+func (p *protocol) unsubscribeCommands(deviceID string) {
+	if !p.bindings[deviceID] {
+		return
+	}
+	delete(p.bindings, deviceID)
+	verifyErrors(p.network.subscriber.UnsubscribeFromDeviceCommands(deviceID), p.log)
+}
@@ -0,0 +1,150 @@
+package knot
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// Recovery is what the integration does about an error returned by Knot Cloud
+type Recovery int
+
+const (
+	// RecoverRetry sends the same request again once its timer expires
+	RecoverRetry Recovery = iota
+	// RecoverRegister registers the device again under a new ID
+	RecoverRegister
+	// RecoverConfig sends the config again
+	RecoverConfig
+	// RecoverGiveUp leaves the device on the error state
+	RecoverGiveUp
+)
+
+// Errors returned by Knot Cloud
+var (
+	ErrAlreadyRegistered = errors.New("thing is already registered")
+	ErrThingNotFound     = errors.New("thing not found")
+	ErrThingMetadata     = errors.New("thing metadata not available yet")
+	ErrConfigNotProvided = errors.New("thing's config not provided")
+	ErrInvalidConfig     = errors.New("thing's config is invalid")
+	ErrUnauthorized      = errors.New("thing is not authorized")
+	ErrCloudUnavailable  = errors.New("knot cloud unavailable")
+	ErrUnknownCloudError = errors.New("unknown knot cloud error")
+)
+
+// CloudError is an error returned by Knot Cloud with its recovery
+type CloudError struct {
+	Message  string
+	Err      error
+	Recovery Recovery
+}
+
+func (e *CloudError) Error() string {
+	return e.Err.Error() + ": " + e.Message
+}
+
+func (e *CloudError) Unwrap() error {
+	return e.Err
+}
+
+// cloudErrorRule maps the messages containing match to a typed error
+type cloudErrorRule struct {
+	match    string
+	err      error
+	recovery Recovery
+}
+
+// cloudErrorRules are checked in order, so the specific messages come first
+var cloudErrorRules = []cloudErrorRule{
+	{"thing is already registered", ErrAlreadyRegistered, RecoverRegister},
+	// Knot Cloud answers the config before the thing metadata is ready
+	{"error getting thing metadata: thing not found", ErrThingMetadata, RecoverConfig},
+	{"thing not found", ErrThingNotFound, RecoverRegister},
+	{"thing's config not provided", ErrConfigNotProvided, RecoverConfig},
+	{"failed to validate if config is valid", ErrInvalidConfig, RecoverGiveUp},
+	{"invalid config", ErrInvalidConfig, RecoverGiveUp},
+	{"unauthorized", ErrUnauthorized, RecoverRegister},
+	{"invalid token", ErrUnauthorized, RecoverRegister},
+	{"forbidden", ErrUnauthorized, RecoverRegister},
+	{"timeout", ErrCloudUnavailable, RecoverRetry},
+	{"unavailable", ErrCloudUnavailable, RecoverRetry},
+	{"connection refused", ErrCloudUnavailable, RecoverRetry},
+}
+
+// classifyCloudError finds the typed error of a message, unknown messages
+// are given up
+func classifyCloudError(message string) *CloudError {
+	lower := strings.ToLower(message)
+	for _, rule := range cloudErrorRules {
+		if strings.Contains(lower, rule.match) {
+			return &CloudError{Message: message, Err: rule.err, Recovery: rule.recovery}
+		}
+	}
+	return &CloudError{Message: message, Err: ErrUnknownCloudError, Recovery: RecoverGiveUp}
+}
+
+// replyError keeps the device answered with a recoverable error waiting on
+// its step, so the recovery runs when the request timer expires and follows
+// the backoff and the attempts left on the step. The other errors move the
+// device to the error state.
+func replyError(device entities.Device, kind requestKind) entities.Device {
+	cloudErr := classifyCloudError(device.Error)
+	if cloudErr.Recovery == RecoverGiveUp || (cloudErr.Recovery == RecoverConfig && kind == kindRegister) {
+		return errorFormat(device, device.Error)
+	}
+	device.State = ""
+	return device
+}
+
+// recoveryState returns the state recovering the device from the error Knot
+// Cloud answered on its step, or an empty state to send the same request
+// again
+func recoveryState(device entities.Device) entities.State {
+	if device.Error == "" {
+		return ""
+	}
+	switch classifyCloudError(device.Error).Recovery {
+	case RecoverRegister:
+		if device.State == entities.KnotWaitReg {
+			return entities.KnotAlreadyReg
+		}
+		return entities.KnotForceDelete
+	case RecoverConfig:
+		// The thing is known, so the config is sent once it is authenticated
+		if device.State == entities.KnotWaitAuth {
+			return entities.KnotAuth
+		}
+	}
+	return ""
+}
+
+// cloudErrorStats counts the messages from Knot Cloud no rule knows
+type cloudErrorStats struct {
+	mu      sync.Mutex
+	unknown map[string]int
+}
+
+func newCloudErrorStats() *cloudErrorStats {
+	return &cloudErrorStats{unknown: make(map[string]int)}
+}
+
+func (s *cloudErrorStats) count(message string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unknown[message]++
+	return s.unknown[message]
+}
+
+func (s *cloudErrorStats) snapshot() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unknown := make(map[string]int, len(s.unknown))
+	for message, count := range s.unknown {
+		unknown[message] = count
+	}
+	return unknown
+}
@@ -0,0 +1,162 @@
+package knot
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+func TestClassifyCloudError(t *testing.T) {
+	tests := []struct {
+		message  string
+		err      error
+		recovery Recovery
+	}{
+		{"Thing is already registered", ErrAlreadyRegistered, RecoverRegister},
+		{"error getting thing metadata: thing not found", ErrThingMetadata, RecoverConfig},
+		{"thing not found", ErrThingNotFound, RecoverRegister},
+		{"thing's config not provided", ErrConfigNotProvided, RecoverConfig},
+		{"failed to validate if config is valid: sensor 1", ErrInvalidConfig, RecoverGiveUp},
+		{"invalid config", ErrInvalidConfig, RecoverGiveUp},
+		{"Unauthorized", ErrUnauthorized, RecoverRegister},
+		{"invalid token", ErrUnauthorized, RecoverRegister},
+		{"forbidden", ErrUnauthorized, RecoverRegister},
+		{"request timeout", ErrCloudUnavailable, RecoverRetry},
+		{"service unavailable", ErrCloudUnavailable, RecoverRetry},
+		{"dial tcp: connection refused", ErrCloudUnavailable, RecoverRetry},
+		{"something else", ErrUnknownCloudError, RecoverGiveUp},
+	}
+	for _, tt := range tests {
+		cloudErr := classifyCloudError(tt.message)
+		if !errors.Is(cloudErr, tt.err) || cloudErr.Recovery != tt.recovery {
+			t.Errorf("classifyCloudError(%q) = %v (recovery %d), want %v (recovery %d)", tt.message, cloudErr, cloudErr.Recovery, tt.err, tt.recovery)
+		}
+		if cloudErr.Message != tt.message {
+			t.Errorf("classifyCloudError(%q) kept message %q", tt.message, cloudErr.Message)
+		}
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	tests := []struct {
+		message string
+		kind    requestKind
+		state   entities.State
+	}{
+		{"thing is already registered", kindRegister, ""},
+		{"thing not found", kindAuth, ""},
+		{"thing's config not provided", kindAuth, ""},
+		{"thing's config not provided", kindRegister, entities.KnotError},
+		{"invalid config", kindConfig, entities.KnotError},
+		{"something else", kindAuth, entities.KnotError},
+		{"service unavailable", kindConfig, ""},
+	}
+	for _, tt := range tests {
+		device := replyError(entities.Device{State: entities.KnotWaitReg, Error: tt.message}, tt.kind)
+		if device.State != tt.state || device.Error != tt.message {
+			t.Errorf("replyError(%q, %s) = state %q error %q, want state %q", tt.message, tt.kind, device.State, device.Error, tt.state)
+		}
+	}
+}
+
+func TestRecoveryState(t *testing.T) {
+	tests := []struct {
+		state   entities.State
+		message string
+		next    entities.State
+	}{
+		{entities.KnotWaitReg, "", ""},
+		{entities.KnotWaitReg, "thing is already registered", entities.KnotAlreadyReg},
+		{entities.KnotWaitAuth, "thing not found", entities.KnotForceDelete},
+		{entities.KnotWaitConfig, "unauthorized", entities.KnotForceDelete},
+		{entities.KnotWaitAuth, "thing's config not provided", entities.KnotAuth},
+		{entities.KnotWaitConfig, "error getting thing metadata: thing not found", ""},
+		{entities.KnotWaitConfig, "service unavailable", ""},
+	}
+	for _, tt := range tests {
+		next := recoveryState(entities.Device{State: tt.state, Error: tt.message})
+		if next != tt.next {
+			t.Errorf("recoveryState(%q, %q) = %q, want %q", tt.state, tt.message, next, tt.next)
+		}
+	}
+}
+
+// expire handles the timeout of the request the device is waiting on as if
+// its timer fired
+func expire(t *testing.T, p *protocol, deviceID string) {
+	t.Helper()
+	p.timers.mu.Lock()
+	pending, ok := p.timers.timers[deviceID]
+	p.timers.mu.Unlock()
+	if !ok {
+		t.Fatalf("device %s has no pending request", deviceID)
+	}
+	err := p.checkTimeout(requestTimeout{deviceID: deviceID, state: pending.state, seq: pending.seq})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// onlyDevice returns the single device held by the protocol
+func onlyDevice(t *testing.T, p *protocol) entities.Device {
+	t.Helper()
+	devices := p.registry.List()
+	if len(devices) != 1 {
+		t.Fatalf("registry holds %d devices, want 1", len(devices))
+	}
+	return devices[0]
+}
+
+func TestRecoveryFollowsAttempts(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		renamed int
+	}{
+		{"no response", "", 0},
+		{"already registered", "thing is already registered", 2},
+		{"unavailable", "service unavailable", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := entities.Device{ID: "0000000000000001", Name: "meter"}
+			p, publisher := newTestProtocol(t, device)
+			conf := entities.KnotConfig{}
+			conf.Timeouts.Register.MaxAttempts = 3
+			p.timers = newRequestTimers(p.ctx, conf)
+			renamed := 0
+			p.setRenameHandler(func(oldID, newID string) { renamed++ })
+
+			_, err := p.machine.fire(p, device, entities.KnotNew)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for attempt := 1; attempt <= 3; attempt++ {
+				device = onlyDevice(t, p)
+				if device.State != entities.KnotWaitReg {
+					t.Fatalf("attempt %d: state = %q, want %q", attempt, device.State, entities.KnotWaitReg)
+				}
+				if tt.message != "" {
+					device.Error = tt.message
+					err = p.updateDevice(replyError(device, kindRegister))
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				expire(t, p, device.ID)
+			}
+
+			device = onlyDevice(t, p)
+			if device.State != entities.KnotQuarantine {
+				t.Errorf("state = %q, want %q", device.State, entities.KnotQuarantine)
+			}
+			if len(publisher.sent) != 3 {
+				t.Errorf("sent %v, want 3 register requests", publisher.sent)
+			}
+			if renamed != tt.renamed {
+				t.Errorf("renamed %d times, want %d", renamed, tt.renamed)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package copergas
+
+import (
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// alarmSensorOffset is added to CodVar to get the ID of the alarm sensor of
+// a variable when the mapping sets none
+const alarmSensorOffset = 1000000
+
+// alarmEvent builds the KNoT event of the alarm sensor of a variable, sent
+// whenever EmAlarmeNivel changes. Each bound uses the least extreme level
+// enabled that has a threshold on the mapping. The thresholds stay off the
+// measurement sensor, so every reading of the variable is still published.
+func alarmEvent(variable entities.Variable, rule entities.AlarmMapping) entities.Event {
+	event := entities.Event{Change: true}
+
+	if variable.CfgAlmBaixo && rule.Low != nil {
+		event.LowerThreshold = *rule.Low
+	} else if variable.CfgAlmMuitoBaixo && rule.VeryLow != nil {
+		event.LowerThreshold = *rule.VeryLow
+	}
+	if variable.CfgAlmAlto && rule.High != nil {
+		event.UpperThreshold = *rule.High
+	} else if variable.CfgAlmMuitoAlto && rule.VeryHigh != nil {
+		event.UpperThreshold = *rule.VeryHigh
+	}
+	return event
+}
+
+// alarmSensor builds the sensor publishing EmAlarmeNivel of the variable
+func alarmSensor(sensorID int, variable entities.Variable, rule entities.AlarmMapping, name string) mappedSensor {
+	schema, _ := entities.NewSchema(schemaName("Alarm "+name), "none/none/bool")
+	return mappedSensor{
+		codVar: variable.CodVar,
+		alarm:  true,
+		config: entities.Config{
+			SensorID: sensorID,
+			Schema:   schema,
+			Event:    alarmEvent(variable, rule),
+		},
+	}
+}
+
+// alarmReading publishes if the variable is on alarm with the time of its reading
+func alarmReading(sensor mappedSensor, variable entities.Variable, reading entities.Data) entities.Data {
+	return entities.Data{
+		SensorID:  sensor.config.SensorID,
+		Value:     variable.EmAlarmeNivel,
+		TimeStamp: reading.TimeStamp,
+	}
+}
@@ -0,0 +1,75 @@
+package copergas
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// alarmVariable is an alarm-enabled flow reading of meter 1
+func alarmVariable(value float32, minute int) entities.Variable {
+	return entities.Variable{
+		CodVar:        7,
+		CodMed:        1,
+		Descricao:     "Flow",
+		Unidade:       "m3/h",
+		CodTpDado:     defaultDataTypeFloat,
+		ValorFloat:    value,
+		DataLeitura:   fmt.Sprintf("2021-03-04T05:%02d:00", minute),
+		AlmHabilitado: true,
+		CfgAlmAlto:    true,
+		CfgAlmBaixo:   true,
+		CfgAlmMudanca: true,
+	}
+}
+
+func TestAlarmThresholdsKeepTheMeasurementSeries(t *testing.T) {
+	low, high := 10.0, 20.0
+	mapper, err := NewMapper(entities.MappingConfig{
+		TimeZone: "UTC",
+		Devices: []entities.DeviceMapping{{
+			CodMed:  1,
+			Sensors: []entities.SensorMapping{{CodVar: 7, Alarm: entities.AlarmMapping{Low: &low, High: &high}}},
+		}},
+	}, NewCodes(entities.CopergasCodes{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for minute, value := range []float32{12, 13, 14, 15, 16} {
+		variable := alarmVariable(value, minute)
+		devices, _ := mapper.Map(entities.Measurements{Variables: map[int]entities.ReceivedData{7: {CodVar: 7, Data: variable}}})
+		if len(devices) != 1 {
+			t.Fatalf("mapped %d things, want 1", len(devices))
+		}
+		device := devices[0]
+
+		var measured bool
+		for _, data := range device.Data {
+			if data.SensorID == 7 && data.Value == float64(value) {
+				measured = true
+			}
+		}
+		if !measured {
+			t.Errorf("reading %v in range was not mapped: %v", value, device.Data)
+		}
+
+		for _, config := range device.Config {
+			switch config.SensorID {
+			case 7:
+				// A sensor with no event publishes every reading
+				if config.Event != (entities.Event{}) {
+					t.Errorf("measurement event = %+v, want none", config.Event)
+				}
+			case 7 + alarmSensorOffset:
+				want := entities.Event{Change: true, LowerThreshold: low, UpperThreshold: high}
+				if config.Event != want {
+					t.Errorf("alarm event = %+v, want %+v", config.Event, want)
+				}
+			default:
+				t.Errorf("unexpected sensor %d", config.SensorID)
+			}
+		}
+	}
+}
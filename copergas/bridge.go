@@ -0,0 +1,117 @@
+package copergas
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/luisfelipemisi/knot/integration/knot"
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// Bridge hands the things built by the mapper to the KNoT integration. A
+// thing is added on first sight and its config is sent again whenever its
+// sensors change.
+type Bridge struct {
+	integration *knot.Integration
+	mapper      *Mapper
+	log         *logrus.Entry
+}
+
+// NewBridge constructs the bridge, making the mapper follow the new IDs the
+// integration gives the things
+func NewBridge(integration *knot.Integration, mapper *Mapper, log *logrus.Entry) *Bridge {
+	integration.SetRenameHandler(mapper.Rename)
+	return &Bridge{integration: integration, mapper: mapper, log: log}
+}
+
+// Publish sends the readings of the variables read to their things. It
+// returns knot.ErrClosed once the integration stopped.
+func (b *Bridge) Publish(measurements entities.Measurements) error {
+	devices, errs := b.mapper.Map(measurements)
+	for _, err := range errs {
+		b.log.Errorln(err)
+	}
+	for _, device := range devices {
+		device, err := b.sync(device)
+		if err != nil {
+			b.log.Errorln(err)
+			continue
+		}
+		err = b.integration.HandleDevice(device)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync applies a discovery report to the things, adding the sensors of the
+// variables found and dropping the ones of the variables lost. A thing left
+// with no sensors is removed.
+func (b *Bridge) Sync(report DiscoveryReport) {
+	devices, errs := b.mapper.Sync(report)
+	for _, err := range errs {
+		b.log.Errorln(err)
+	}
+	for _, device := range devices {
+		if len(device.Config) > 0 {
+			_, err := b.sync(device)
+			if err != nil {
+				b.log.Errorln(err)
+			}
+			continue
+		}
+		if _, ok := b.integration.Devices().Get(device.ID); !ok {
+			continue
+		}
+		err := b.integration.RemoveDevice(device.ID)
+		if err != nil {
+			b.log.Errorln(fmt.Errorf("error removing thing %s: %w", device.Name, err))
+		}
+	}
+}
+
+// sync adds the thing the integration does not know and sends the config
+// of the one whose sensors changed
+func (b *Bridge) sync(device entities.Device) (entities.Device, error) {
+	stored, ok := b.integration.Devices().Get(device.ID)
+	if !ok {
+		stored, ok = b.adopt(device)
+	}
+	if !ok {
+		added := device
+		added.Data = nil
+		id, err := b.integration.AddDevice(added)
+		if err != nil {
+			return device, fmt.Errorf("error adding thing %s: %w", device.Name, err)
+		}
+		device.ID = id
+		return device, nil
+	}
+
+	device.ID = stored.ID
+	if !reflect.DeepEqual(stored.Config, device.Config) {
+		err := b.integration.UpdateDeviceConfig(device.ID, device.Config)
+		if err != nil {
+			return device, fmt.Errorf("error updating config of thing %s: %w", device.Name, err)
+		}
+	}
+	return device, nil
+}
+
+// adopt finds by its name the thing registered again under a new ID before
+// a restart, as long as no other thing has the same name
+func (b *Bridge) adopt(device entities.Device) (entities.Device, bool) {
+	var found []entities.Device
+	for _, stored := range b.integration.Devices().List() {
+		if stored.Name == device.Name && !b.mapper.known(stored.ID) {
+			found = append(found, stored)
+		}
+	}
+	if len(found) != 1 {
+		return entities.Device{}, false
+	}
+	b.mapper.Rename(device.ID, found[0].ID)
+	return found[0], true
+}
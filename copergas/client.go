@@ -0,0 +1,171 @@
+package copergas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// Client calls the Copergas API, logging in with the configured
+// credentials. It is safe for concurrent use.
+type Client struct {
+	conf    entities.CopergasConfig
+	http    *http.Client
+	baseURL string
+	tokens  *tokenCache
+	codes   Codes
+	log     *logrus.Entry
+}
+
+// Option changes how the client reaches the Copergas API
+type Option func(*Client)
+
+// WithHTTPClient sends the requests through the given HTTP client
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.http = client
+	}
+}
+
+// WithBaseURL replaces the configured API URL, such as the URL of a local
+// stand-in server
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = baseURL
+	}
+}
+
+// NewClient constructs the Copergas API client
+func NewClient(conf entities.CopergasConfig, log *logrus.Entry, options ...Option) *Client {
+	c := &Client{
+		conf:    conf,
+		http:    http.DefaultClient,
+		baseURL: conf.Endpoints.APIUrl,
+		tokens:  newTokenCache(),
+		codes:   NewCodes(conf.Codes),
+		log:     log,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Variable reads the variable with the given code
+func (c *Client) Variable(ctx context.Context, codVar int) (entities.Variable, error) {
+	variable := entities.Variable{}
+	err := c.do(ctx, http.MethodGet, c.variablePath(codVar), nil, &variable)
+	if err != nil {
+		return entities.Variable{}, fmt.Errorf("error reading variable %d: %w", codVar, err)
+	}
+	return variable, nil
+}
+
+func (c *Client) variablePath(codVar int) string {
+	return strings.TrimSuffix(c.conf.Endpoints.Variable, "/") + "/" + strconv.Itoa(codVar)
+}
+
+// login gets a token with the configured credentials
+func (c *Client) login(ctx context.Context) (entities.Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", "password")
+	form.Set("username", c.conf.Credentials.Username)
+	form.Set("password", c.conf.Credentials.Password)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(c.conf.Endpoints.AuthToken), strings.NewReader(form.Encode()))
+	if err != nil {
+		return entities.Token{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	token := entities.Token{}
+	err = c.send(request, &token)
+	if err != nil {
+		return entities.Token{}, fmt.Errorf("error logging in: %w", err)
+	}
+	return token, nil
+}
+
+// do sends an authenticated request, encoding body and decoding the
+// response into out when they are not nil. A request refused with 401 is
+// sent once more after logging in again.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.doOnce(ctx, method, path, data, out)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Code == http.StatusUnauthorized {
+		c.log.Println("copergas token refused, logging in again")
+		c.tokens.invalidate()
+		err = c.doOnce(ctx, method, path, data, out)
+	}
+	return err
+}
+
+func (c *Client) doOnce(ctx context.Context, method, path string, data []byte, out interface{}) error {
+	token, err := c.tokens.get(ctx, c.login)
+	if err != nil {
+		return err
+	}
+
+	var content io.Reader
+	if data != nil {
+		content = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, c.url(path), content)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	if data != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(request, out)
+}
+
+func (c *Client) send(request *http.Request, out interface{}) error {
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &StatusError{Code: response.StatusCode, Status: response.Status}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+func (c *Client) url(path string) string {
+	return strings.TrimSuffix(c.baseURL, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// StatusError is returned when the Copergas API answers with an error status
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "copergas api: " + e.Status
+}
@@ -0,0 +1,212 @@
+package copergas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeAPI stands in for the Copergas API, counting the logins and the
+// variable reads
+type fakeAPI struct {
+	mu      sync.Mutex
+	expires time.Time
+	logins  int
+	reads   int
+	// refuse answers the next reads with 401, every read when negative
+	refuse int
+	tokens []string
+	// Each read takes delay, the most reads running at once is kept on
+	// maxInFlight
+	delay       time.Duration
+	inFlight    int
+	maxInFlight int
+	// missing are the variables answered with 404
+	missing map[int]bool
+	// variables are the variables read, the ones not set only have their code
+	variables map[int]entities.Variable
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/variable/") {
+		f.read(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/token":
+		if r.FormValue("username") != "user" || r.FormValue("password") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.logins++
+		json.NewEncoder(w).Encode(entities.Token{
+			AccessToken: fmt.Sprintf("token-%d", f.logins),
+			ExpiresUtc:  f.expires.Format(time.RFC3339),
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// read answers the read of a variable, out of the lock while it waits
+func (f *fakeAPI) read(w http.ResponseWriter, r *http.Request) {
+	codVar, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/variable/"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	f.reads++
+	f.tokens = append(f.tokens, r.Header.Get("Authorization"))
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	refused := f.refuse != 0
+	if refused {
+		f.refuse--
+	}
+	missing := f.missing[codVar]
+	variable, ok := f.variables[codVar]
+	if !ok {
+		variable = entities.Variable{CodVar: codVar}
+	}
+	f.mu.Unlock()
+
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	f.inFlight--
+	f.mu.Unlock()
+
+	switch {
+	case refused:
+		w.WriteHeader(http.StatusUnauthorized)
+	case missing:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		json.NewEncoder(w).Encode(variable)
+	}
+}
+
+// newTestClient builds a client of the fake API, with its clock set to now
+func newTestClient(t *testing.T, api *fakeAPI, now time.Time) *Client {
+	t.Helper()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	conf := entities.CopergasConfig{}
+	conf.Credentials.Username = "user"
+	conf.Credentials.Password = "secret"
+	conf.Endpoints.AuthToken = "/token"
+	conf.Endpoints.Variable = "/variable/"
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	c := NewClient(conf, logrus.NewEntry(log), WithBaseURL(server.URL), WithHTTPClient(server.Client()))
+	c.tokens.now = func() time.Time { return now }
+	return c
+}
+
+func TestClientCachesToken(t *testing.T) {
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	api := &fakeAPI{expires: now.Add(time.Hour)}
+	c := newTestClient(t, api, now)
+
+	for i := 0; i < 3; i++ {
+		variable, err := c.Variable(context.Background(), 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if variable.CodVar != 7 {
+			t.Fatalf("read variable %d, want 7", variable.CodVar)
+		}
+	}
+	if api.logins != 1 || api.reads != 3 {
+		t.Errorf("%d logins and %d reads, want 1 login and 3 reads", api.logins, api.reads)
+	}
+	for _, token := range api.tokens {
+		if token != "Bearer token-1" {
+			t.Errorf("read with %q, want the cached token", token)
+		}
+	}
+}
+
+func TestClientRefreshesBeforeExpiry(t *testing.T) {
+	expires := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	api := &fakeAPI{expires: expires}
+	c := newTestClient(t, api, expires.Add(-2*tokenRefreshMargin))
+
+	tests := []struct {
+		now    time.Time
+		logins int
+	}{
+		{expires.Add(-2 * tokenRefreshMargin), 1},
+		{expires.Add(-tokenRefreshMargin - time.Second), 1},
+		// Renewed within the margin, before Knot Cloud refuses the token
+		{expires.Add(-tokenRefreshMargin + time.Second), 2},
+	}
+	for _, tt := range tests {
+		now := tt.now
+		c.tokens.now = func() time.Time { return now }
+		_, err := c.Variable(context.Background(), 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if api.logins != tt.logins {
+			t.Errorf("at %s: %d logins, want %d", tt.now, api.logins, tt.logins)
+		}
+	}
+	if got := api.tokens[len(api.tokens)-1]; got != "Bearer token-2" {
+		t.Errorf("read with %q after the refresh, want the new token", got)
+	}
+}
+
+func TestClientLogsInAgainOn401(t *testing.T) {
+	tests := []struct {
+		name   string
+		refuse int
+		failed bool
+	}{
+		{"token revoked", 1, false},
+		{"credentials refused", -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+			api := &fakeAPI{expires: now.Add(time.Hour), refuse: tt.refuse}
+			c := newTestClient(t, api, now)
+
+			_, err := c.Variable(context.Background(), 7)
+			var statusErr *StatusError
+			if failed := errors.As(err, &statusErr); failed != tt.failed {
+				t.Fatalf("Variable() = %v, want failure %v", err, tt.failed)
+			}
+			if tt.failed && statusErr.Code != http.StatusUnauthorized {
+				t.Errorf("failed with %d, want 401", statusErr.Code)
+			}
+			// A single login again and a single retry, even when refused again
+			if api.logins != 2 || api.reads != 2 {
+				t.Errorf("%d logins and %d reads, want 2 of each", api.logins, api.reads)
+			}
+			if len(api.tokens) == 2 && api.tokens[1] != "Bearer token-2" {
+				t.Errorf("retried with %q, want the new token", api.tokens[1])
+			}
+		})
+	}
+}
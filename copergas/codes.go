@@ -0,0 +1,79 @@
+package copergas
+
+import (
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// Codes used when the configuration sets none, the ones of the Copergas
+// installation the integration was first deployed on
+const (
+	defaultDataTypeInteger  = 1
+	defaultDataTypeFloat    = 2
+	defaultDataTypeString   = 3
+	defaultDataTypeDateTime = 4
+	defaultDataTypeBit      = 5
+
+	defaultWritePending = 1
+	defaultWriteRunning = 2
+	defaultWriteDone    = 3
+)
+
+// dataKind is how the value of a variable is stored, whatever code the API
+// gives its data type
+type dataKind int
+
+const (
+	kindUnknown dataKind = iota
+	kindInteger
+	kindFloat
+	kindString
+	kindDateTime
+	kindBit
+)
+
+// Codes translates the configured codes of the data types and write status
+// of the Copergas API
+type Codes struct {
+	kinds        map[int]dataKind
+	writePending int
+	writeRunning map[int]bool
+	writeDone    int
+}
+
+// NewCodes constructs the codes, the ones not configured keep their defaults
+func NewCodes(conf entities.CopergasCodes) Codes {
+	c := Codes{
+		kinds: map[int]dataKind{
+			code(conf.Integer, defaultDataTypeInteger):   kindInteger,
+			code(conf.Float, defaultDataTypeFloat):       kindFloat,
+			code(conf.String, defaultDataTypeString):     kindString,
+			code(conf.DateTime, defaultDataTypeDateTime): kindDateTime,
+			code(conf.Bit, defaultDataTypeBit):           kindBit,
+		},
+		writePending: code(conf.WritePending, defaultWritePending),
+		writeRunning: make(map[int]bool),
+		writeDone:    code(conf.WriteDone, defaultWriteDone),
+	}
+	running := conf.WriteRunning
+	if len(running) == 0 {
+		running = []int{defaultWriteRunning}
+	}
+	for _, status := range running {
+		c.writeRunning[status] = true
+	}
+	// The station may not have picked the write up yet
+	c.writeRunning[c.writePending] = true
+	return c
+}
+
+// kind returns how the value of the variable is stored
+func (c Codes) kind(variable entities.Variable) dataKind {
+	return c.kinds[variable.CodTpDado]
+}
+
+func code(value, fallback int) int {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,87 @@
+package copergas
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// SensorResolver finds the Copergas variable behind a KNoT sensor
+type SensorResolver interface {
+	ResolveSensor(deviceID string, sensorID int) (codVar int, ok bool)
+}
+
+// Commands answers the commands KNoT Cloud sends to the devices with the
+// Copergas variables behind their sensors
+type Commands struct {
+	ctx      context.Context
+	client   *Client
+	resolver SensorResolver
+	location *time.Location
+}
+
+// NewCommands constructs the handler of the KNoT commands, the calls to
+// Copergas are cancelled with ctx. Dates are read on the given location.
+func NewCommands(ctx context.Context, client *Client, resolver SensorResolver, location *time.Location) *Commands {
+	return &Commands{ctx: ctx, client: client, resolver: resolver, location: location}
+}
+
+// HandleDataRequest reads the variables behind the sensors
+func (c *Commands) HandleDataRequest(deviceID string, sensorIDs []int) ([]entities.Data, error) {
+	var data []entities.Data
+	var failed []string
+	for _, sensorID := range sensorIDs {
+		codVar, ok := c.resolver.ResolveSensor(deviceID, sensorID)
+		if !ok {
+			failed = append(failed, fmt.Sprintf("sensor %d has no variable", sensorID))
+			continue
+		}
+		variable, err := c.client.Variable(c.ctx, codVar)
+		if err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		reading, err := c.client.codes.Reading(sensorID, variable, c.location)
+		if err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		data = append(data, reading)
+	}
+	return data, joinErrors(failed)
+}
+
+// HandleDataUpdate writes the values to the variables behind the sensors,
+// returning the readings of the writes the stations confirmed
+func (c *Commands) HandleDataUpdate(deviceID string, data []entities.Data) ([]entities.Data, error) {
+	var confirmed []entities.Data
+	var failed []string
+	for _, reading := range data {
+		codVar, ok := c.resolver.ResolveSensor(deviceID, reading.SensorID)
+		if !ok {
+			failed = append(failed, fmt.Sprintf("sensor %d has no variable", reading.SensorID))
+			continue
+		}
+		err := c.client.Write(c.ctx, codVar, reading.Value)
+		if err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		confirmed = append(confirmed, entities.Data{
+			SensorID:  reading.SensorID,
+			Value:     reading.Value,
+			TimeStamp: time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+	return confirmed, joinErrors(failed)
+}
+
+func joinErrors(failed []string) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(failed, "; "))
+}
@@ -0,0 +1,79 @@
+package copergas
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// Decode returns the value of the variable with the Go type matching its
+// CodTpDado. Numbers use ValorConv when the API sends it, otherwise they are
+// corrected by FatorCorrecao and ParcelaCorrecao. Only raw integers are
+// scaled by Escala decimal places, floats already come as real numbers.
+func (c Codes) Decode(variable entities.Variable, location *time.Location) (interface{}, error) {
+	switch c.kind(variable) {
+	case kindInteger:
+		if variable.ValorConv != nil {
+			return numberValue(float64(*variable.ValorConv), variable), nil
+		}
+		value := float64(variable.ValorInteger) / math.Pow10(variable.Escala)
+		return numberValue(correct(value, variable), variable), nil
+	case kindFloat:
+		if variable.ValorConv != nil {
+			return float64(*variable.ValorConv), nil
+		}
+		return correct(float64(variable.ValorFloat), variable), nil
+	case kindString:
+		return variable.ValorString, nil
+	case kindDateTime:
+		date, err := parseDataLeitura(variable.ValorDateTime, location)
+		if err != nil {
+			return nil, fmt.Errorf("variable %d: %w", variable.CodVar, err)
+		}
+		return date.UTC().Format(time.RFC3339), nil
+	case kindBit:
+		return variable.BitValue, nil
+	}
+	return nil, fmt.Errorf("variable %d: unknown data type %d", variable.CodVar, variable.CodTpDado)
+}
+
+// ValueType returns the KNoT value type of the decoded variable
+func (c Codes) ValueType(variable entities.Variable) int {
+	switch c.kind(variable) {
+	case kindInteger:
+		if corrected(variable) {
+			return entities.ValueTypeFloat
+		}
+		return entities.ValueTypeInt
+	case kindBit:
+		return entities.ValueTypeBool
+	case kindString, kindDateTime:
+		return entities.ValueTypeRaw
+	}
+	return entities.ValueTypeFloat
+}
+
+// correct applies the linear correction of the variable
+func correct(value float64, variable entities.Variable) float64 {
+	if variable.FatorCorrecao != 0 {
+		value *= float64(variable.FatorCorrecao)
+	}
+	return value + float64(variable.ParcelaCorrecao)
+}
+
+// corrected reports if the correction can make an integer fractional
+func corrected(variable entities.Variable) bool {
+	return variable.Escala != 0 ||
+		(variable.FatorCorrecao != 0 && variable.FatorCorrecao != 1) ||
+		variable.ParcelaCorrecao != 0
+}
+
+// numberValue keeps integer variables as int unless they are corrected
+func numberValue(value float64, variable entities.Variable) interface{} {
+	if corrected(variable) {
+		return value
+	}
+	return int(math.Round(value))
+}
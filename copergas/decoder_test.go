@@ -0,0 +1,151 @@
+package copergas
+
+import (
+	"testing"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+func TestDecode(t *testing.T) {
+	conv := float32(12.5)
+	location := time.FixedZone("BRT", -3*60*60)
+	codes := NewCodes(entities.CopergasCodes{})
+	tests := []struct {
+		name      string
+		variable  entities.Variable
+		value     interface{}
+		valueType int
+	}{
+		{
+			name:      "integer",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeInteger, ValorInteger: 42},
+			value:     42,
+			valueType: entities.ValueTypeInt,
+		},
+		{
+			name:      "integer with identity factor",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeInteger, ValorInteger: 42, FatorCorrecao: 1},
+			value:     42,
+			valueType: entities.ValueTypeInt,
+		},
+		{
+			name:      "integer scaled",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeInteger, ValorInteger: 1234, Escala: 2},
+			value:     12.34,
+			valueType: entities.ValueTypeFloat,
+		},
+		{
+			name:      "integer corrected",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeInteger, ValorInteger: 100, Escala: 1, FatorCorrecao: 2, ParcelaCorrecao: 0.5},
+			value:     20.5,
+			valueType: entities.ValueTypeFloat,
+		},
+		{
+			name:      "integer converted by the API",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeInteger, ValorInteger: 125, Escala: 1, ValorConv: &conv},
+			value:     12.5,
+			valueType: entities.ValueTypeFloat,
+		},
+		{
+			name:      "float",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeFloat, ValorFloat: 3.5},
+			value:     3.5,
+			valueType: entities.ValueTypeFloat,
+		},
+		{
+			name:      "float is not scaled",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeFloat, ValorFloat: 3.5, Escala: 2, FatorCorrecao: 2, ParcelaCorrecao: 1},
+			value:     8.0,
+			valueType: entities.ValueTypeFloat,
+		},
+		{
+			name:      "float converted by the API",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeFloat, ValorFloat: 3.5, ValorConv: &conv},
+			value:     12.5,
+			valueType: entities.ValueTypeFloat,
+		},
+		{
+			name:      "bit set",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeBit, BitValue: true, ValorInteger: 0},
+			value:     true,
+			valueType: entities.ValueTypeBool,
+		},
+		{
+			name:      "bit clear",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeBit, ValorInteger: 1},
+			value:     false,
+			valueType: entities.ValueTypeBool,
+		},
+		{
+			name:      "string",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeString, ValorString: "open"},
+			value:     "open",
+			valueType: entities.ValueTypeRaw,
+		},
+		{
+			name:      "datetime on the location",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeDateTime, ValorDateTime: "2021-03-04 05:06:07"},
+			value:     "2021-03-04T08:06:07Z",
+			valueType: entities.ValueTypeRaw,
+		},
+		{
+			name:      "datetime in day first order",
+			variable:  entities.Variable{CodTpDado: defaultDataTypeDateTime, ValorDateTime: "04/03/2021 05:06:07"},
+			value:     "2021-03-04T08:06:07Z",
+			valueType: entities.ValueTypeRaw,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := codes.Decode(tt.variable, location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if number, ok := value.(float64); ok {
+				want, _ := tt.value.(float64)
+				if diff := number - want; diff > 1e-6 || diff < -1e-6 {
+					t.Errorf("Decode() = %v, want %v", value, tt.value)
+				}
+			} else if value != tt.value {
+				t.Errorf("Decode() = %#v, want %#v", value, tt.value)
+			}
+			if valueType := codes.ValueType(tt.variable); valueType != tt.valueType {
+				t.Errorf("ValueType() = %d, want %d", valueType, tt.valueType)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []entities.Variable{
+		{CodVar: 1, CodTpDado: defaultDataTypeDateTime, ValorDateTime: "yesterday"},
+		{CodVar: 2, CodTpDado: 9},
+	}
+	for _, variable := range tests {
+		if value, err := NewCodes(entities.CopergasCodes{}).Decode(variable, time.UTC); err == nil {
+			t.Errorf("Decode(variable %d) = %v, want an error", variable.CodVar, value)
+		}
+	}
+}
+
+func TestDecodeConfiguredCodes(t *testing.T) {
+	codes := NewCodes(entities.CopergasCodes{Float: 7, Bit: 2})
+	tests := []struct {
+		variable entities.Variable
+		value    interface{}
+	}{
+		{entities.Variable{CodTpDado: 7, ValorFloat: 1.5}, 1.5},
+		{entities.Variable{CodTpDado: 2, BitValue: true}, true},
+		{entities.Variable{CodTpDado: defaultDataTypeInteger, ValorInteger: 3}, 3},
+	}
+	for _, tt := range tests {
+		value, err := codes.Decode(tt.variable, time.UTC)
+		if err != nil || value != tt.value {
+			t.Errorf("Decode(type %d) = %v, %v, want %v", tt.variable.CodTpDado, value, err, tt.value)
+		}
+	}
+	if value, err := codes.Decode(entities.Variable{CodTpDado: defaultDataTypeBit}, time.UTC); err == nil {
+		t.Errorf("Decode() of the replaced float code = %v, want an error", value)
+	}
+}
@@ -0,0 +1,185 @@
+package copergas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultDiscoveryInterval is used when the discovery interval is not configured
+const defaultDiscoveryInterval = time.Hour
+
+// DiscoveryReport tells the variables found and lost on a discovery cycle
+type DiscoveryReport struct {
+	Added   []entities.Variable
+	Removed []entities.Variable
+	// Variables are the codes of every variable kept, sorted
+	Variables []int
+}
+
+// Discovery lists the variables of the configured stations, meters and
+// companies, keeping the ones matching the rules
+type Discovery struct {
+	mu          sync.Mutex
+	client      *Client
+	conf        entities.DiscoveryConfig
+	description *regexp.Regexp
+	known       map[int]entities.Variable
+	log         *logrus.Entry
+}
+
+// NewDiscovery constructs the discovery following the configured rules. At
+// least one station, meter or company must be listed, otherwise every cycle
+// would find nothing and report the variables read as removed.
+func NewDiscovery(client *Client, conf entities.DiscoveryConfig, log *logrus.Entry) (*Discovery, error) {
+	d := &Discovery{
+		client: client,
+		conf:   conf,
+		known:  make(map[int]entities.Variable),
+		log:    log,
+	}
+	if len(d.scopes()) == 0 {
+		return nil, fmt.Errorf("discovery lists no station, meter or company")
+	}
+	if conf.Description != "" {
+		var err error
+		d.description, err = regexp.Compile(conf.Description)
+		if err != nil {
+			return nil, fmt.Errorf("invalid description rule: %w", err)
+		}
+	}
+	for _, pattern := range conf.TagPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid tag pattern %q: %w", pattern, err)
+		}
+	}
+	return d, nil
+}
+
+// Run discovers the variables every interval, sending each report on out,
+// until ctx is cancelled
+func (d *Discovery) Run(ctx context.Context, out chan<- DiscoveryReport) {
+	ticker := time.NewTicker(entities.Seconds(d.conf.IntervalInSeconds, defaultDiscoveryInterval))
+	defer ticker.Stop()
+
+	for {
+		report, err := d.Discover(ctx)
+		if err != nil {
+			d.log.Errorln(err)
+		} else {
+			select {
+			case out <- report:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Discover lists the variables once, comparing them to the last cycle. A
+// failed listing keeps the variables known.
+func (d *Discovery) Discover(ctx context.Context) (DiscoveryReport, error) {
+	found := make(map[int]entities.Variable)
+	for _, scope := range d.scopes() {
+		variables, err := d.client.Variables(ctx, scope)
+		if err != nil {
+			return DiscoveryReport{}, err
+		}
+		for _, variable := range variables {
+			if d.match(variable) {
+				found[variable.CodVar] = variable
+			}
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	report := DiscoveryReport{}
+	for codVar, variable := range found {
+		if _, ok := d.known[codVar]; !ok {
+			report.Added = append(report.Added, variable)
+		}
+		report.Variables = append(report.Variables, codVar)
+	}
+	for codVar, variable := range d.known {
+		if _, ok := found[codVar]; !ok {
+			report.Removed = append(report.Removed, variable)
+		}
+	}
+	d.known = found
+
+	sort.Ints(report.Variables)
+	sortVariables(report.Added)
+	sortVariables(report.Removed)
+	if len(report.Added) > 0 || len(report.Removed) > 0 {
+		d.log.Printf("discovered %d variables: %d added, %d removed", len(report.Variables), len(report.Added), len(report.Removed))
+	}
+	return report, nil
+}
+
+// scopes builds the query of each station, meter and company listed
+func (d *Discovery) scopes() []url.Values {
+	var scopes []url.Values
+	add := func(key string, codes []int) {
+		for _, code := range codes {
+			scopes = append(scopes, url.Values{key: []string{strconv.Itoa(code)}})
+		}
+	}
+	add("codEst", d.conf.Stations)
+	add("codMed", d.conf.Meters)
+	add("codEmpr", d.conf.Companies)
+	return scopes
+}
+
+// match checks the variable against every rule set
+func (d *Discovery) match(variable entities.Variable) bool {
+	if d.conf.TelemetryOnly && !variable.FazerTelemetria {
+		return false
+	}
+	if d.conf.HistoryOnly && !variable.GravarHistorico {
+		return false
+	}
+	if d.description != nil && !d.description.MatchString(variable.Descricao) {
+		return false
+	}
+	if len(d.conf.TagPatterns) == 0 {
+		return true
+	}
+	for _, pattern := range d.conf.TagPatterns {
+		if ok, _ := path.Match(pattern, variable.TagWeb); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Variables lists the variables matching the query
+func (c *Client) Variables(ctx context.Context, query url.Values) ([]entities.Variable, error) {
+	variables := []entities.Variable{}
+	err := c.do(ctx, http.MethodGet, c.conf.Endpoints.Variables+"?"+query.Encode(), nil, &variables)
+	if err != nil {
+		return nil, fmt.Errorf("error listing variables of %s: %w", query.Encode(), err)
+	}
+	return variables, nil
+}
+
+func sortVariables(variables []entities.Variable) {
+	sort.Slice(variables, func(i, j int) bool { return variables[i].CodVar < variables[j].CodVar })
+}
@@ -0,0 +1,193 @@
+package copergas
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeListing stands in for the Copergas API listing the variables of each
+// station, meter and company, keyed by the query
+type fakeListing struct {
+	mu        sync.Mutex
+	variables map[string][]int
+	fail      bool
+}
+
+func (f *fakeListing) set(variables map[string][]int, fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.variables = variables
+	f.fail = fail
+}
+
+func (f *fakeListing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/token":
+		json.NewEncoder(w).Encode(entities.Token{AccessToken: "token"})
+	case "/variables":
+		if f.fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		variables := []entities.Variable{}
+		for _, codVar := range f.variables[r.URL.RawQuery] {
+			variables = append(variables, entities.Variable{CodVar: codVar, FazerTelemetria: true})
+		}
+		json.NewEncoder(w).Encode(variables)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestDiscovery(t *testing.T, listing *fakeListing, conf entities.DiscoveryConfig) *Discovery {
+	t.Helper()
+	server := httptest.NewServer(listing)
+	t.Cleanup(server.Close)
+
+	clientConf := entities.CopergasConfig{}
+	clientConf.Endpoints.AuthToken = "/token"
+	clientConf.Endpoints.Variables = "/variables"
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	client := NewClient(clientConf, logrus.NewEntry(log), WithBaseURL(server.URL), WithHTTPClient(server.Client()))
+	d, err := NewDiscovery(client, conf, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func variableCodes(variables []entities.Variable) []int {
+	codVars := []int{}
+	for _, variable := range variables {
+		codVars = append(codVars, variable.CodVar)
+	}
+	return codVars
+}
+
+func TestDiscoverReportsChanges(t *testing.T) {
+	listing := &fakeListing{}
+	d := newTestDiscovery(t, listing, entities.DiscoveryConfig{Stations: []int{1}, Meters: []int{5}})
+
+	tests := []struct {
+		name      string
+		listed    map[string][]int
+		fail      bool
+		added     []int
+		removed   []int
+		variables []int
+	}{
+		{
+			name:      "first cycle",
+			listed:    map[string][]int{"codEst=1": {2, 1}, "codMed=5": {3}},
+			added:     []int{1, 2, 3},
+			removed:   []int{},
+			variables: []int{1, 2, 3},
+		},
+		{
+			name:      "one added and one removed",
+			listed:    map[string][]int{"codEst=1": {1}, "codMed=5": {3, 4}},
+			added:     []int{4},
+			removed:   []int{2},
+			variables: []int{1, 3, 4},
+		},
+		{
+			name: "failed listing",
+			fail: true,
+		},
+		{
+			name:      "unchanged after the failure",
+			listed:    map[string][]int{"codEst=1": {1}, "codMed=5": {3, 4}},
+			added:     []int{},
+			removed:   []int{},
+			variables: []int{1, 3, 4},
+		},
+		{
+			name:      "variable in two scopes",
+			listed:    map[string][]int{"codEst=1": {1, 3}, "codMed=5": {3, 4}},
+			added:     []int{},
+			removed:   []int{},
+			variables: []int{1, 3, 4},
+		},
+	}
+	for _, tt := range tests {
+		listing.set(tt.listed, tt.fail)
+
+		report, err := d.Discover(context.Background())
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: Discover() succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := variableCodes(report.Added); !reflect.DeepEqual(got, tt.added) {
+			t.Errorf("%s: added %v, want %v", tt.name, got, tt.added)
+		}
+		if got := variableCodes(report.Removed); !reflect.DeepEqual(got, tt.removed) {
+			t.Errorf("%s: removed %v, want %v", tt.name, got, tt.removed)
+		}
+		if !reflect.DeepEqual(report.Variables, tt.variables) {
+			t.Errorf("%s: variables %v, want %v", tt.name, report.Variables, tt.variables)
+		}
+	}
+}
+
+func TestNewDiscoveryRefusesInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		conf entities.DiscoveryConfig
+	}{
+		{"no scope", entities.DiscoveryConfig{Enabled: true, TelemetryOnly: true}},
+		{"invalid description", entities.DiscoveryConfig{Stations: []int{1}, Description: "("}},
+		{"invalid tag pattern", entities.DiscoveryConfig{Stations: []int{1}, TagPatterns: []string{"["}}},
+	}
+	for _, tt := range tests {
+		if _, err := NewDiscovery(nil, tt.conf, nil); err == nil {
+			t.Errorf("%s: NewDiscovery() succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestDiscoveryMatch(t *testing.T) {
+	conf := entities.DiscoveryConfig{
+		Companies:     []int{1},
+		TelemetryOnly: true,
+		TagPatterns:   []string{"PT-*", "FT-*"},
+		Description:   "(?i)pressure|flow",
+	}
+	d, err := NewDiscovery(nil, conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		variable entities.Variable
+		matched  bool
+	}{
+		{entities.Variable{FazerTelemetria: true, TagWeb: "PT-01", Descricao: "Pressure"}, true},
+		{entities.Variable{FazerTelemetria: true, TagWeb: "FT-02", Descricao: "flow"}, true},
+		{entities.Variable{FazerTelemetria: false, TagWeb: "PT-01", Descricao: "Pressure"}, false},
+		{entities.Variable{FazerTelemetria: true, TagWeb: "TT-01", Descricao: "Pressure"}, false},
+		{entities.Variable{FazerTelemetria: true, TagWeb: "PT-01", Descricao: "temperature"}, false},
+	}
+	for _, tt := range tests {
+		if got := d.match(tt.variable); got != tt.matched {
+			t.Errorf("match(%+v) = %v, want %v", tt.variable, got, tt.matched)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package copergas
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// groupSeparator joins the names on group paths and thing names
+const groupSeparator = " / "
+
+// Group is a node of the affiliation tree
+type Group struct {
+	CodAgr    int
+	CodAgrPai int
+	Name      string
+	// Path joins the names from the root group down to this one
+	Path string
+}
+
+// hierarchy keeps the affiliation tree and the groups each thing belongs to
+type hierarchy struct {
+	names   map[int]string
+	parents map[int]int
+	devices map[string]map[int]bool
+}
+
+func newHierarchy(names map[int]string) *hierarchy {
+	return &hierarchy{
+		names:   names,
+		parents: make(map[int]int),
+		devices: make(map[string]map[int]bool),
+	}
+}
+
+// add links the thing to the groups of the variable affiliations
+func (h *hierarchy) add(deviceKey string, affiliations []entities.Affiliation) {
+	for _, affiliation := range affiliations {
+		if affiliation.CodAgr == 0 {
+			continue
+		}
+		if affiliation.CodAgrPai != 0 {
+			h.parents[affiliation.CodAgr] = affiliation.CodAgrPai
+		}
+		groups, ok := h.devices[deviceKey]
+		if !ok {
+			groups = make(map[int]bool)
+			h.devices[deviceKey] = groups
+		}
+		groups[affiliation.CodAgr] = true
+	}
+}
+
+// group builds the node of the tree with its path
+func (h *hierarchy) group(codAgr int) Group {
+	names := make([]string, 0, 4)
+	for _, code := range h.chain(codAgr) {
+		names = append(names, h.name(code))
+	}
+	return Group{
+		CodAgr:    codAgr,
+		CodAgrPai: h.parents[codAgr],
+		Name:      h.name(codAgr),
+		Path:      strings.Join(names, groupSeparator),
+	}
+}
+
+// chain lists the groups from the root down to the given one
+func (h *hierarchy) chain(codAgr int) []int {
+	codes := []int{codAgr}
+	seen := map[int]bool{codAgr: true}
+	// A loop on the affiliations stops the path where it closes
+	for parent := h.parents[codAgr]; parent != 0 && !seen[parent]; parent = h.parents[parent] {
+		seen[parent] = true
+		codes = append([]int{parent}, codes...)
+	}
+	return codes
+}
+
+// deepest finds the group of the thing furthest from the root, the first
+// by path among the ones as deep
+func (h *hierarchy) deepest(deviceKey string) (Group, bool) {
+	var found Group
+	depth := 0
+	for codAgr := range h.devices[deviceKey] {
+		group := h.group(codAgr)
+		length := len(h.chain(codAgr))
+		if length > depth || (length == depth && group.Path < found.Path) {
+			found, depth = group, length
+		}
+	}
+	return found, depth > 0
+}
+
+func (h *hierarchy) name(codAgr int) string {
+	if name, ok := h.names[codAgr]; ok {
+		return name
+	}
+	return fmt.Sprintf("group %d", codAgr)
+}
+
+// paths lists the path of each group of the thing, sorted
+func (h *hierarchy) paths(deviceKey string) []string {
+	var paths []string
+	for codAgr := range h.devices[deviceKey] {
+		paths = append(paths, h.group(codAgr).Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// thingName names the thing after its station and meter, used when it has
+// no affiliation group
+func thingName(variable entities.Variable, groupBy string) string {
+	station := strings.TrimSpace(variable.Estacao)
+	meter := strings.TrimSpace(variable.Medidor)
+	if groupBy == GroupByStation || meter == "" {
+		return station
+	}
+	if station == "" {
+		return meter
+	}
+	return station + groupSeparator + meter
+}
+
+// Groups lists every group of the affiliation tree sorted by path
+func (m *Mapper) Groups() []Group {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	codes := make(map[int]bool)
+	for _, groups := range m.hierarchy.devices {
+		for codAgr := range groups {
+			codes[codAgr] = true
+		}
+	}
+	for codAgr, parent := range m.hierarchy.parents {
+		codes[codAgr] = true
+		codes[parent] = true
+	}
+
+	groups := make([]Group, 0, len(codes))
+	for codAgr := range codes {
+		groups = append(groups, m.hierarchy.group(codAgr))
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Path < groups[j].Path })
+	return groups
+}
+
+// GroupPaths lists the paths of the groups the thing belongs to
+func (m *Mapper) GroupPaths(deviceID string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.hierarchy.paths(m.ids[deviceID])
+}
+
+// DevicesInGroup lists the IDs of the things on the group with the given
+// path or on any group below it, sorted
+func (m *Mapper) DevicesInGroup(path string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for key, mapped := range m.devices {
+		for _, groupPath := range m.hierarchy.paths(key) {
+			if groupPath == path || strings.HasPrefix(groupPath, path+groupSeparator) {
+				ids = append(ids, mapped.device.ID)
+				break
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,101 @@
+package copergas
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// groupedVariable builds a variable of the meter on the given groups, each
+// affiliation given as the group and its parent
+func groupedVariable(codVar, codMed int, station, meter string, groups ...[2]int) entities.Variable {
+	variable := entities.Variable{
+		CodVar:      codVar,
+		CodMed:      codMed,
+		CodTpDado:   defaultDataTypeFloat,
+		ValorFloat:  1.5,
+		Descricao:   "pressure",
+		DataLeitura: "2021-03-04T05:06:07",
+		Estacao:     station,
+		Medidor:     meter,
+	}
+	for _, group := range groups {
+		variable.AgrVinculoList = append(variable.AgrVinculoList, entities.Affiliation{CodAgr: group[0], CodAgrPai: group[1], CodVar: codVar})
+	}
+	return variable
+}
+
+func TestGroupNaming(t *testing.T) {
+	api := &fakeAPI{variables: map[int]entities.Variable{
+		1: groupedVariable(1, 10, "North", "M1", [2]int{3, 2}, [2]int{2, 1}),
+		2: groupedVariable(2, 20, "North", "M2", [2]int{4, 1}),
+		3: groupedVariable(3, 30, "South", "M3"),
+		4: groupedVariable(4, 40, "East", ""),
+		5: groupedVariable(5, 50, "West", "M5", [2]int{6, 7}, [2]int{7, 6}),
+		6: groupedVariable(6, 60, "North", "M6", [2]int{3, 2}),
+		7: groupedVariable(7, 70, "North", "M7", [2]int{8, 0}),
+	}}
+	p := newTestPoller(t, api, 4, 1, 2, 3, 4, 5, 6, 7)
+	mapper := newTestMapper(t, entities.MappingConfig{
+		Groups:  map[int]string{1: "Company", 2: "Region", 3: "Plant", 4: "Depot", 6: "Loop A", 7: "Loop B"},
+		Devices: []entities.DeviceMapping{{CodMed: 60, Name: "Named"}},
+	})
+
+	devices, errs := mapper.Map(p.Poll(context.Background()))
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	names := make(map[string]string)
+	for _, device := range devices {
+		names[device.ID] = device.Name
+	}
+	tests := []struct {
+		codMed int
+		name   string
+	}{
+		// The deepest group names the thing
+		{10, "Company / Region / Plant"},
+		{20, "Company / Depot"},
+		// Things with no group are named after their station and meter
+		{30, "South / M3"},
+		{40, "East"},
+		// A loop on the affiliations stops where it closes
+		{50, "Loop A / Loop B"},
+		// The mapping name wins over the groups
+		{60, "Named"},
+		// Groups with no name on the mapping are named after their code
+		{70, "group 8"},
+	}
+	for _, tt := range tests {
+		id := deviceID(mapper.groupKey(entities.Variable{CodMed: tt.codMed}))
+		if names[id] != tt.name {
+			t.Errorf("meter %d named %q, want %q", tt.codMed, names[id], tt.name)
+		}
+	}
+
+	var paths []string
+	for _, group := range mapper.Groups() {
+		paths = append(paths, group.Path)
+	}
+	wantPaths := []string{"Company", "Company / Depot", "Company / Region", "Company / Region / Plant", "Loop A / Loop B", "Loop B / Loop A", "group 8"}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("Groups() paths = %v, want %v", paths, wantPaths)
+	}
+
+	meter10 := deviceID("meter 10")
+	if got := mapper.GroupPaths(meter10); !reflect.DeepEqual(got, []string{"Company / Region", "Company / Region / Plant"}) {
+		t.Errorf("GroupPaths() = %v", got)
+	}
+	inRegion := []string{meter10, deviceID("meter 60")}
+	if inRegion[0] > inRegion[1] {
+		inRegion[0], inRegion[1] = inRegion[1], inRegion[0]
+	}
+	if got := mapper.DevicesInGroup("Company / Region"); !reflect.DeepEqual(got, inRegion) {
+		t.Errorf("DevicesInGroup() = %v, want %v", got, inRegion)
+	}
+	if got := mapper.DevicesInGroup("Company / Reg"); len(got) != 0 {
+		t.Errorf("DevicesInGroup() of a path prefix = %v, want none", got)
+	}
+}
@@ -0,0 +1,533 @@
+package copergas
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"gopkg.in/yaml.v2"
+)
+
+// Ways of grouping the variables into things
+const (
+	GroupByMeter   = "meter"
+	GroupByStation = "station"
+)
+
+const (
+	// maxSchemaName is the longest sensor name KNoT accepts
+	maxSchemaName = 23
+
+	// defaultSchema is used for the units with no matching KNoT type
+	defaultSchema = "none/none/float"
+)
+
+// defaultUnits maps the usual Copergas units to KNoT schemas
+var defaultUnits = map[string]string{
+	"m³/h": "volumeFlow/cubicMeterPerHour/float",
+	"m3/h": "volumeFlow/cubicMeterPerHour/float",
+	"°C":   "temperature/celsius/float",
+	"ºC":   "temperature/celsius/float",
+	"bar":  "pressure/bar/float",
+	"psi":  "pressure/psi/float",
+	"Pa":   "pressure/pascal/float",
+	"V":    "voltage/volt/float",
+	"A":    "current/ampere/float",
+	"kW":   "power/kilowatt/float",
+	"kWh":  "energy/kilowattHour/float",
+	"s":    "time/second/float",
+}
+
+// dataLeituraLayouts are the layouts accepted on DataLeitura
+var dataLeituraLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"02/01/2006 15:04:05",
+}
+
+// LoadMapping reads the mapping rules from a YAML file
+func LoadMapping(path string) (entities.MappingConfig, error) {
+	conf := entities.MappingConfig{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return conf, fmt.Errorf("error reading mapping: %w", err)
+	}
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return conf, fmt.Errorf("error decoding mapping: %w", err)
+	}
+	return conf, nil
+}
+
+// SensorIDError reports a variable left out of its thing because another
+// variable of the thing has its sensor ID
+type SensorIDError struct {
+	CodVar   int
+	SensorID int
+	TakenBy  int
+}
+
+func (e *SensorIDError) Error() string {
+	return fmt.Sprintf("variable %d: sensor %d is taken by variable %d", e.CodVar, e.SensorID, e.TakenBy)
+}
+
+// mappedSensor is a sensor made of a Copergas variable
+type mappedSensor struct {
+	codVar int
+	alarm  bool
+	config entities.Config
+}
+
+// mappedDevice is a thing made of the variables of a station or meter
+type mappedDevice struct {
+	key     string
+	device  entities.Device
+	sensors map[int]mappedSensor
+	// alarms maps the variables to the sensors publishing their alarm
+	alarms map[int]int
+}
+
+// Mapper turns the Copergas variables into KNoT things. Sensors are kept
+// once seen, so the config of a thing does not change when a variable
+// fails to be read. It is safe for concurrent use.
+type Mapper struct {
+	mu        sync.RWMutex
+	conf      entities.MappingConfig
+	location  *time.Location
+	codes     Codes
+	devices   map[string]*mappedDevice
+	ids       map[string]string
+	hierarchy *hierarchy
+	// refused are the variables whose sensor ID is taken, reported once
+	refused map[int]bool
+}
+
+// NewMapper constructs the mapper following the rules, decoding the values
+// with the codes of the Copergas API
+func NewMapper(conf entities.MappingConfig, codes Codes) (*Mapper, error) {
+	switch conf.GroupBy {
+	case "":
+		conf.GroupBy = GroupByMeter
+	case GroupByMeter, GroupByStation:
+	default:
+		return nil, fmt.Errorf("unknown grouping %q", conf.GroupBy)
+	}
+
+	location := time.Local
+	if conf.TimeZone != "" {
+		var err error
+		location, err = time.LoadLocation(conf.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("error loading time zone: %w", err)
+		}
+	}
+
+	for unit, spec := range conf.Units {
+		if _, err := entities.NewSchema("", spec); err != nil {
+			return nil, fmt.Errorf("unit %q: %w", unit, err)
+		}
+	}
+	for _, device := range conf.Devices {
+		claimed := make(map[int]int)
+		for _, sensor := range device.Sensors {
+			sensorID, alarmID := sensorIDs(sensor.CodVar, sensor)
+			if sensorID == alarmID {
+				return nil, &SensorIDError{CodVar: sensor.CodVar, SensorID: sensorID, TakenBy: sensor.CodVar}
+			}
+			for _, id := range []int{sensorID, alarmID} {
+				if codVar, ok := claimed[id]; ok {
+					return nil, &SensorIDError{CodVar: sensor.CodVar, SensorID: id, TakenBy: codVar}
+				}
+				claimed[id] = sensor.CodVar
+			}
+
+			if sensor.Schema == "" {
+				continue
+			}
+			if _, err := entities.NewSchema("", sensor.Schema); err != nil {
+				return nil, fmt.Errorf("variable %d: %w", sensor.CodVar, err)
+			}
+		}
+	}
+
+	return &Mapper{
+		conf:      conf,
+		location:  location,
+		codes:     codes,
+		devices:   make(map[string]*mappedDevice),
+		ids:       make(map[string]string),
+		hierarchy: newHierarchy(conf.Groups),
+		refused:   make(map[int]bool),
+	}, nil
+}
+
+// Map returns the things with the readings of the variables read, the
+// variables with an error are skipped. The variables whose sensor ID is
+// taken are skipped too, each one reported on the first time it is seen.
+func (m *Mapper) Map(measurements entities.Measurements) ([]entities.Device, []error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	readings := make(map[string][]entities.Data)
+	codVars := make([]int, 0, len(measurements.Variables))
+	for codVar := range measurements.Variables {
+		codVars = append(codVars, codVar)
+	}
+	sort.Ints(codVars)
+
+	var errs []error
+	for _, codVar := range codVars {
+		received := measurements.Variables[codVar]
+		if received.Error != nil || m.refused[codVar] {
+			continue
+		}
+		device := m.device(received.Data)
+		sensor, err := m.sensor(device, received.Data)
+		if err != nil {
+			m.refused[codVar] = true
+			errs = append(errs, err)
+			continue
+		}
+
+		data, err := m.codes.Reading(sensor.config.SensorID, received.Data, m.location)
+		if err != nil {
+			continue
+		}
+		readings[device.key] = append(readings[device.key], data)
+		if alarmID, ok := device.alarms[codVar]; ok {
+			alarm := alarmReading(device.sensors[alarmID], received.Data, data)
+			readings[device.key] = append(readings[device.key], alarm)
+		}
+	}
+
+	devices := make([]entities.Device, 0, len(readings))
+	for key, data := range readings {
+		mapped := m.devices[key]
+		device := mapped.device
+		device.Config = mapped.config()
+		device.Data = data
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices, errs
+}
+
+// Sync adds the sensors of the variables discovered and removes the ones of
+// the variables lost, returning the things whose config changed and the
+// variables refused because their sensor ID is taken
+func (m *Mapper) Sync(report DiscoveryReport) ([]entities.Device, []error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	changed := make(map[string]*mappedDevice)
+	for _, variable := range report.Added {
+		if m.refused[variable.CodVar] {
+			continue
+		}
+		device := m.device(variable)
+		if _, err := m.sensor(device, variable); err != nil {
+			m.refused[variable.CodVar] = true
+			errs = append(errs, err)
+			continue
+		}
+		changed[device.key] = device
+	}
+	for _, variable := range report.Removed {
+		delete(m.refused, variable.CodVar)
+		device, ok := m.devices[m.groupKey(variable)]
+		if !ok {
+			continue
+		}
+		for sensorID, sensor := range device.sensors {
+			if sensor.codVar == variable.CodVar {
+				delete(device.sensors, sensorID)
+			}
+		}
+		delete(device.alarms, variable.CodVar)
+		changed[device.key] = device
+	}
+
+	devices := make([]entities.Device, 0, len(changed))
+	for _, mapped := range changed {
+		device := mapped.device
+		device.Config = mapped.config()
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices, errs
+}
+
+// ResolveSensor finds the variable behind the sensor of a thing
+func (m *Mapper) ResolveSensor(deviceID string, sensorID int) (int, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	mapped, ok := m.devices[m.ids[deviceID]]
+	if !ok {
+		return 0, false
+	}
+	// Alarms are read only
+	sensor, ok := mapped.sensors[sensorID]
+	if !ok || sensor.alarm {
+		return 0, false
+	}
+	return sensor.codVar, true
+}
+
+// Rename follows the new ID KNoT gives a thing when it registers again, it
+// is meant to be the rename handler of the integration
+func (m *Mapper) Rename(oldID, newID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.ids[oldID]
+	if !ok {
+		return
+	}
+	delete(m.ids, oldID)
+	m.ids[newID] = key
+	m.devices[key].device.ID = newID
+}
+
+// device finds the thing of the variable, creating it on first sight
+func (m *Mapper) device(variable entities.Variable) *mappedDevice {
+	key := m.groupKey(variable)
+	m.hierarchy.add(key, variable.AgrVinculoList)
+	if mapped, ok := m.devices[key]; ok {
+		return mapped
+	}
+
+	// Things are named after the path of their deepest affiliation group,
+	// or after their station and meter when they have none, unless the
+	// mapping names them
+	rule, _ := m.deviceRule(variable)
+	name := rule.Name
+	if group, ok := m.hierarchy.deepest(key); ok && name == "" {
+		name = group.Path
+	}
+	if name == "" {
+		name = thingName(variable, m.conf.GroupBy)
+	}
+	if name == "" {
+		name = key
+	}
+	mapped := &mappedDevice{
+		key:     key,
+		device:  entities.Device{ID: deviceID(key), Name: name},
+		sensors: make(map[int]mappedSensor),
+		alarms:  make(map[int]int),
+	}
+	m.devices[key] = mapped
+	m.ids[mapped.device.ID] = key
+	return mapped
+}
+
+// sensor finds the sensor of the variable, creating it on first sight. The
+// variable is refused when another one of the thing has its sensor ID.
+func (m *Mapper) sensor(device *mappedDevice, variable entities.Variable) (mappedSensor, error) {
+	for _, sensor := range device.sensors {
+		if sensor.codVar == variable.CodVar && !sensor.alarm {
+			return sensor, nil
+		}
+	}
+
+	// Variables with no sensor ID set keep their code as ID, so adding a
+	// variable never changes the ID of the others
+	rule := m.sensorRule(variable)
+	sensorID, alarmID := sensorIDs(variable.CodVar, rule)
+	ids := []int{sensorID}
+	if variable.AlmHabilitado {
+		ids = append(ids, alarmID)
+	}
+	for _, id := range ids {
+		if codVar, ok := m.takenBy(device, variable, id); ok {
+			return mappedSensor{}, &SensorIDError{CodVar: variable.CodVar, SensorID: id, TakenBy: codVar}
+		}
+	}
+
+	name := rule.Name
+	if name == "" {
+		name = variable.Descricao
+	}
+	schema, err := entities.NewSchema(schemaName(name), rule.Schema)
+	if rule.Schema == "" {
+		// The value type comes from the data type, the unit can only
+		// tell the type and unit of the sensor
+		schema, err = entities.NewSchema(schemaName(name), m.unitSchema(variable.Unidade))
+		schema.ValueType = m.codes.ValueType(variable)
+		if err == nil {
+			err = schema.Validate()
+		}
+	}
+	if err != nil {
+		schema, _ = entities.NewSchema(schemaName(name), defaultSchema)
+		schema.ValueType = m.codes.ValueType(variable)
+	}
+	sensor := mappedSensor{
+		codVar: variable.CodVar,
+		config: entities.Config{
+			SensorID: sensorID,
+			Schema:   schema,
+		},
+	}
+	device.sensors[sensorID] = sensor
+
+	if variable.AlmHabilitado {
+		alarm := alarmSensor(alarmID, variable, rule.Alarm, name)
+		device.sensors[alarmID] = alarm
+		device.alarms[variable.CodVar] = alarmID
+	}
+	return sensor, nil
+}
+
+// takenBy finds the other variable of the thing with the sensor ID, either
+// already mapped or set on the mapping, which keeps it even before the
+// variable is first read
+func (m *Mapper) takenBy(device *mappedDevice, variable entities.Variable, id int) (int, bool) {
+	if sensor, ok := device.sensors[id]; ok && sensor.codVar != variable.CodVar {
+		return sensor.codVar, true
+	}
+	rule, _ := m.deviceRule(variable)
+	for _, sensor := range rule.Sensors {
+		if sensor.CodVar == variable.CodVar {
+			continue
+		}
+		sensorID, alarmID := sensorIDs(sensor.CodVar, sensor)
+		if sensorID == id || alarmID == id {
+			return sensor.CodVar, true
+		}
+	}
+	return 0, false
+}
+
+// sensorIDs returns the IDs of the sensors publishing the variable and its
+// alarm, the mapping sets them or they follow from CodVar
+func sensorIDs(codVar int, rule entities.SensorMapping) (int, int) {
+	sensorID := codVar
+	if rule.SensorID != nil {
+		sensorID = *rule.SensorID
+	}
+	alarmID := codVar + alarmSensorOffset
+	if rule.Alarm.SensorID != nil {
+		alarmID = *rule.Alarm.SensorID
+	}
+	return sensorID, alarmID
+}
+
+// Reading returns the decoded value of the variable stamped with the time
+// it was read
+func (c Codes) Reading(sensorID int, variable entities.Variable, location *time.Location) (entities.Data, error) {
+	timestamp, err := parseDataLeitura(variable.DataLeitura, location)
+	if err != nil {
+		return entities.Data{}, fmt.Errorf("variable %d: %w", variable.CodVar, err)
+	}
+	value, err := c.Decode(variable, location)
+	if err != nil {
+		return entities.Data{}, err
+	}
+	return entities.Data{
+		SensorID:  sensorID,
+		Value:     value,
+		TimeStamp: timestamp.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// known reports if a thing of the mapper has the ID
+func (m *Mapper) known(deviceID string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.ids[deviceID]
+	return ok
+}
+
+// Location is the time zone of the Copergas dates
+func (m *Mapper) Location() *time.Location {
+	return m.location
+}
+
+func (m *Mapper) groupKey(variable entities.Variable) string {
+	if m.conf.GroupBy == GroupByStation {
+		return fmt.Sprintf("station %d", variable.CodEst)
+	}
+	return fmt.Sprintf("meter %d", variable.CodMed)
+}
+
+func (m *Mapper) deviceRule(variable entities.Variable) (entities.DeviceMapping, bool) {
+	for _, rule := range m.conf.Devices {
+		if m.conf.GroupBy == GroupByStation && rule.CodEst == variable.CodEst {
+			return rule, true
+		}
+		if m.conf.GroupBy == GroupByMeter && rule.CodMed == variable.CodMed {
+			return rule, true
+		}
+	}
+	return entities.DeviceMapping{}, false
+}
+
+func (m *Mapper) sensorRule(variable entities.Variable) entities.SensorMapping {
+	rule, _ := m.deviceRule(variable)
+	for _, sensor := range rule.Sensors {
+		if sensor.CodVar == variable.CodVar {
+			return sensor
+		}
+	}
+	return entities.SensorMapping{}
+}
+
+func (m *Mapper) unitSchema(unit string) string {
+	unit = strings.TrimSpace(unit)
+	if spec, ok := m.conf.Units[unit]; ok {
+		return spec
+	}
+	if spec, ok := defaultUnits[unit]; ok {
+		return spec
+	}
+	return defaultSchema
+}
+
+// config lists the sensors sorted by ID
+func (d *mappedDevice) config() []entities.Config {
+	config := make([]entities.Config, 0, len(d.sensors))
+	for _, sensor := range d.sensors {
+		config = append(config, sensor.config)
+	}
+	sort.Slice(config, func(i, j int) bool { return config[i].SensorID < config[j].SensorID })
+	return config
+}
+
+// deviceID derives the ID the thing is added with from its group. The
+// integration keeps it unless Knot Cloud refuses it, the new ID given then
+// reaches the mapper through Rename.
+func deviceID(key string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte("copergas " + key))
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+func schemaName(name string) string {
+	name = strings.TrimSpace(name)
+	if len([]rune(name)) > maxSchemaName {
+		name = string([]rune(name)[:maxSchemaName])
+	}
+	return name
+}
+
+func parseDataLeitura(dataLeitura string, location *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, dataLeitura); err == nil {
+		return t, nil
+	}
+	for _, layout := range dataLeituraLayouts {
+		if t, err := time.ParseInLocation(layout, dataLeitura, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid dataLeitura %q", dataLeitura)
+}
@@ -0,0 +1,208 @@
+package copergas
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+func sensorID(id int) *int { return &id }
+
+// meterVariable builds a float variable of meter 1, station 2, read at a
+// fixed time
+func meterVariable(codVar int, alarm bool) entities.Variable {
+	return entities.Variable{
+		CodVar:        codVar,
+		CodMed:        1,
+		CodEst:        2,
+		CodTpDado:     defaultDataTypeFloat,
+		ValorFloat:    1.5,
+		Descricao:     "pressure",
+		DataLeitura:   "2021-03-04T05:06:07",
+		AlmHabilitado: alarm,
+	}
+}
+
+func newTestMapper(t *testing.T, conf entities.MappingConfig) *Mapper {
+	t.Helper()
+	conf.TimeZone = "UTC"
+	mapper, err := NewMapper(conf, NewCodes(entities.CopergasCodes{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mapper
+}
+
+func mapVariables(mapper *Mapper, variables ...entities.Variable) ([]entities.Device, []error) {
+	measurements := entities.Measurements{Variables: make(map[int]entities.ReceivedData)}
+	for _, variable := range variables {
+		measurements.Variables[variable.CodVar] = entities.ReceivedData{CodVar: variable.CodVar, Data: variable}
+	}
+	return mapper.Map(measurements)
+}
+
+func sensorIDsOf(device entities.Device) []int {
+	ids := make([]int, 0, len(device.Config))
+	for _, config := range device.Config {
+		ids = append(ids, config.SensorID)
+	}
+	return ids
+}
+
+func TestStableIDs(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     entities.MappingConfig
+		deviceID string
+		sensors  []int
+	}{
+		{
+			name:     "variable codes",
+			conf:     entities.MappingConfig{},
+			deviceID: "9a8ed28e071f1c5d",
+			sensors:  []int{7, 8, 7 + alarmSensorOffset},
+		},
+		{
+			name:     "grouped by station",
+			conf:     entities.MappingConfig{GroupBy: GroupByStation},
+			deviceID: "806daf071b792a29",
+			sensors:  []int{7, 8, 7 + alarmSensorOffset},
+		},
+		{
+			name: "mapped sensor IDs",
+			conf: entities.MappingConfig{Devices: []entities.DeviceMapping{{
+				CodMed: 1,
+				Sensors: []entities.SensorMapping{{
+					CodVar:   7,
+					SensorID: sensorID(1),
+					Alarm:    entities.AlarmMapping{SensorID: sensorID(2)},
+				}},
+			}}},
+			deviceID: "9a8ed28e071f1c5d",
+			sensors:  []int{1, 2, 8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A new mapper, as after a restart, gives the same IDs
+			for i := 0; i < 2; i++ {
+				devices, errs := mapVariables(newTestMapper(t, tt.conf), meterVariable(7, true), meterVariable(8, false))
+				if len(errs) != 0 || len(devices) != 1 {
+					t.Fatalf("Map() = %+v, %v, want one thing", devices, errs)
+				}
+				if devices[0].ID != tt.deviceID {
+					t.Errorf("ID = %s, want %s", devices[0].ID, tt.deviceID)
+				}
+				if got := sensorIDsOf(devices[0]); !reflect.DeepEqual(got, tt.sensors) {
+					t.Errorf("sensors = %v, want %v", got, tt.sensors)
+				}
+			}
+		})
+	}
+}
+
+func TestNewMapperRefusesTakenSensorID(t *testing.T) {
+	tests := []struct {
+		name    string
+		sensors []entities.SensorMapping
+		err     SensorIDError
+	}{
+		{
+			name:    "code of another variable",
+			sensors: []entities.SensorMapping{{CodVar: 7}, {CodVar: 8, SensorID: sensorID(7)}},
+			err:     SensorIDError{CodVar: 8, SensorID: 7, TakenBy: 7},
+		},
+		{
+			name:    "alarm of another variable",
+			sensors: []entities.SensorMapping{{CodVar: 7}, {CodVar: 8, SensorID: sensorID(7 + alarmSensorOffset)}},
+			err:     SensorIDError{CodVar: 8, SensorID: 7 + alarmSensorOffset, TakenBy: 7},
+		},
+		{
+			name:    "alarm on a sensor ID",
+			sensors: []entities.SensorMapping{{CodVar: 7, SensorID: sensorID(1)}, {CodVar: 8, Alarm: entities.AlarmMapping{SensorID: sensorID(1)}}},
+			err:     SensorIDError{CodVar: 8, SensorID: 1, TakenBy: 7},
+		},
+		{
+			name:    "alarm on its own variable",
+			sensors: []entities.SensorMapping{{CodVar: 7, SensorID: sensorID(1), Alarm: entities.AlarmMapping{SensorID: sensorID(1)}}},
+			err:     SensorIDError{CodVar: 7, SensorID: 1, TakenBy: 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := entities.MappingConfig{Devices: []entities.DeviceMapping{{CodMed: 1, Sensors: tt.sensors}}}
+			_, err := NewMapper(conf, NewCodes(entities.CopergasCodes{}))
+			var idErr *SensorIDError
+			if !errors.As(err, &idErr) || *idErr != tt.err {
+				t.Errorf("err = %v, want %v", err, &tt.err)
+			}
+		})
+	}
+}
+
+func TestMapRefusesTakenSensorID(t *testing.T) {
+	tests := []struct {
+		name      string
+		conf      entities.MappingConfig
+		variables []entities.Variable
+		err       SensorIDError
+		sensors   []int
+	}{
+		{
+			// Variable 7 is read before variable 8, whose mapping keeps the ID
+			name: "code set on the mapping of another variable",
+			conf: entities.MappingConfig{Devices: []entities.DeviceMapping{{
+				CodMed:  1,
+				Sensors: []entities.SensorMapping{{CodVar: 8, SensorID: sensorID(7)}},
+			}}},
+			variables: []entities.Variable{meterVariable(7, false), meterVariable(8, false)},
+			err:       SensorIDError{CodVar: 7, SensorID: 7, TakenBy: 8},
+			sensors:   []int{7},
+		},
+		{
+			name:      "code of the alarm of another variable",
+			variables: []entities.Variable{meterVariable(7, true), meterVariable(7+alarmSensorOffset, false)},
+			err:       SensorIDError{CodVar: 7 + alarmSensorOffset, SensorID: 7 + alarmSensorOffset, TakenBy: 7},
+			sensors:   []int{7, 7 + alarmSensorOffset},
+		},
+		{
+			name:      "alarm on the code of another variable",
+			variables: []entities.Variable{meterVariable(7+alarmSensorOffset, false), meterVariable(7, true)},
+			err:       SensorIDError{CodVar: 7, SensorID: 7 + alarmSensorOffset, TakenBy: 7 + alarmSensorOffset},
+			sensors:   []int{7 + alarmSensorOffset},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapper := newTestMapper(t, tt.conf)
+			// Map reads the variables sorted by code, so map them one by one
+			var errs []error
+			var devices []entities.Device
+			for _, variable := range tt.variables {
+				mapped, mapErrs := mapVariables(mapper, variable)
+				errs = append(errs, mapErrs...)
+				if len(mapped) > 0 {
+					devices = mapped
+				}
+			}
+
+			if len(errs) != 1 {
+				t.Fatalf("errs = %v, want one", errs)
+			}
+			var idErr *SensorIDError
+			if !errors.As(errs[0], &idErr) || *idErr != tt.err {
+				t.Errorf("err = %v, want %v", errs[0], &tt.err)
+			}
+			if len(devices) != 1 || !reflect.DeepEqual(sensorIDsOf(devices[0]), tt.sensors) {
+				t.Errorf("devices = %+v, want sensors %v", devices, tt.sensors)
+			}
+
+			// The refused variable is reported only once
+			if _, errs := mapVariables(mapper, tt.variables...); len(errs) != 0 {
+				t.Errorf("errs = %v on the next cycle, want none", errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package copergas
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// VariableReader reads the variables, either the Poller or the Scheduler
+type VariableReader interface {
+	Run(ctx context.Context, out chan<- entities.Measurements)
+	SetVariables(variables []int)
+}
+
+// Pipeline reads the Copergas variables and publishes the fresh readings to
+// KNoT. When discovery is enabled, the variables read and the things follow
+// each discovery report.
+type Pipeline struct {
+	reader    VariableReader
+	bridge    *Bridge
+	staleness *Staleness
+	discovery *Discovery
+	log       *logrus.Entry
+}
+
+// NewPipeline constructs the pipeline of the variables the reader reads
+func NewPipeline(client *Client, reader VariableReader, bridge *Bridge, conf entities.CopergasConfig, log *logrus.Entry) (*Pipeline, error) {
+	p := &Pipeline{
+		reader:    reader,
+		bridge:    bridge,
+		staleness: NewStaleness(conf, bridge.mapper.Location()),
+		log:       log,
+	}
+	if conf.Discovery.Enabled {
+		var err error
+		p.discovery, err = NewDiscovery(client, conf.Discovery, log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Run reads and publishes the variables until ctx is cancelled or the
+// integration stops, when it returns knot.ErrClosed
+func (p *Pipeline) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	measurements := make(chan entities.Measurements)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.reader.Run(ctx, measurements)
+	}()
+
+	// reports stays nil, never ready, when discovery is disabled
+	var reports chan DiscoveryReport
+	if p.discovery != nil {
+		reports = make(chan DiscoveryReport)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.discovery.Run(ctx, reports)
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case report := <-reports:
+			p.bridge.Sync(report)
+			p.reader.SetVariables(report.Variables)
+		case read := <-measurements:
+			fresh, events := p.staleness.Filter(read)
+			for _, event := range events {
+				p.log.Println(staleMessage(event))
+			}
+			err := p.bridge.Publish(fresh)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func staleMessage(event StalenessEvent) string {
+	if event.Outdated {
+		return fmt.Sprintf("variable %d is marked outdated, read at %s", event.CodVar, event.DataLeitura)
+	}
+	return fmt.Sprintf("variable %d is stale, read %s ago", event.CodVar, event.Age)
+}
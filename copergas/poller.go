@@ -0,0 +1,108 @@
+package copergas
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults used when the polling is not configured
+const (
+	defaultPollInterval          = time.Minute
+	defaultMaxConcurrentRequests = 4
+)
+
+// Poller reads the pertinent variables every cycle
+type Poller struct {
+	mu          sync.Mutex
+	client      *Client
+	variables   []int
+	interval    time.Duration
+	concurrency int
+	log         *logrus.Entry
+}
+
+// NewPoller constructs the poller of the configured pertinent variables
+func NewPoller(client *Client, conf entities.CopergasConfig, log *logrus.Entry) *Poller {
+	p := &Poller{
+		client:      client,
+		variables:   append([]int(nil), conf.PertinentVariables...),
+		interval:    entities.Seconds(conf.TimeBetweenRequestsInSeconds, defaultPollInterval),
+		concurrency: conf.MaxConcurrentRequests,
+		log:         log,
+	}
+	if p.concurrency <= 0 {
+		p.concurrency = defaultMaxConcurrentRequests
+	}
+	return p
+}
+
+// Run polls the variables every interval, sending each snapshot on out,
+// until ctx is cancelled
+func (p *Poller) Run(ctx context.Context, out chan<- entities.Measurements) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		measurements := p.Poll(ctx)
+		select {
+		case out <- measurements:
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SetVariables replaces the variables read, such as the ones discovered
+func (p *Poller) SetVariables(variables []int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.variables = append([]int(nil), variables...)
+}
+
+// Poll reads every variable once. A variable that could not be read is
+// kept on the snapshot with its error.
+func (p *Poller) Poll(ctx context.Context) entities.Measurements {
+	p.mu.Lock()
+	variables := p.variables
+	p.mu.Unlock()
+
+	measurements := entities.Measurements{Variables: make(map[int]entities.ReceivedData, len(variables))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, p.concurrency)
+	for _, codVar := range variables {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return measurements
+		}
+
+		wg.Add(1)
+		go func(codVar int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			variable, err := p.client.Variable(ctx, codVar)
+			if err != nil {
+				p.log.Errorln(err)
+			}
+			mu.Lock()
+			measurements.Variables[codVar] = entities.ReceivedData{CodVar: codVar, Error: err, Data: variable}
+			mu.Unlock()
+		}(codVar)
+	}
+	wg.Wait()
+	return measurements
+}
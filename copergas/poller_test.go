@@ -0,0 +1,103 @@
+package copergas
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestPoller(t *testing.T, api *fakeAPI, concurrency int, variables ...int) *Poller {
+	t.Helper()
+	now := time.Now()
+	api.expires = now.Add(time.Hour)
+	c := newTestClient(t, api, now)
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	conf := entities.CopergasConfig{PertinentVariables: variables, MaxConcurrentRequests: concurrency}
+	return NewPoller(c, conf, logrus.NewEntry(log))
+}
+
+func TestPollBoundsConcurrency(t *testing.T) {
+	tests := []struct {
+		concurrency int
+		want        int
+	}{
+		{1, 1},
+		{3, 3},
+		{0, defaultMaxConcurrentRequests},
+	}
+	for _, tt := range tests {
+		api := &fakeAPI{delay: 20 * time.Millisecond}
+		p := newTestPoller(t, api, tt.concurrency, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+		measurements := p.Poll(context.Background())
+		if len(measurements.Variables) != 10 {
+			t.Errorf("concurrency %d: read %d variables, want 10", tt.concurrency, len(measurements.Variables))
+		}
+		for codVar, received := range measurements.Variables {
+			if received.Error != nil || received.Data.CodVar != codVar {
+				t.Errorf("concurrency %d: variable %d = %+v", tt.concurrency, codVar, received)
+			}
+		}
+		if api.maxInFlight != tt.want {
+			t.Errorf("concurrency %d: %d reads at once, want %d", tt.concurrency, api.maxInFlight, tt.want)
+		}
+	}
+}
+
+func TestPollKeepsFailedVariables(t *testing.T) {
+	api := &fakeAPI{missing: map[int]bool{2: true}}
+	p := newTestPoller(t, api, 2, 1, 2, 3)
+
+	measurements := p.Poll(context.Background())
+	if len(measurements.Variables) != 3 {
+		t.Fatalf("read %v, want every variable", measurements.Variables)
+	}
+	var statusErr *StatusError
+	if err := measurements.Variables[2].Error; !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotFound {
+		t.Errorf("variable 2 error = %v, want a 404", err)
+	}
+	for _, codVar := range []int{1, 3} {
+		if err := measurements.Variables[codVar].Error; err != nil {
+			t.Errorf("variable %d error = %v", codVar, err)
+		}
+	}
+}
+
+func TestPollStopsWhenCancelled(t *testing.T) {
+	api := &fakeAPI{delay: 50 * time.Millisecond}
+	p := newTestPoller(t, api, 1, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 70*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	measurements := p.Poll(ctx)
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Poll() took %v after the cancel", elapsed)
+	}
+	if len(measurements.Variables) == 10 {
+		t.Errorf("read every variable, want the poll stopped")
+	}
+}
+
+func TestPollerSetVariables(t *testing.T) {
+	api := &fakeAPI{}
+	p := newTestPoller(t, api, 2, 1, 2)
+
+	p.SetVariables([]int{3, 4, 5})
+	measurements := p.Poll(context.Background())
+	for _, codVar := range []int{3, 4, 5} {
+		if _, ok := measurements.Variables[codVar]; !ok {
+			t.Errorf("variable %d not read", codVar)
+		}
+	}
+	if len(measurements.Variables) != 3 {
+		t.Errorf("read %d variables, want 3", len(measurements.Variables))
+	}
+}
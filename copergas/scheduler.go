@@ -0,0 +1,399 @@
+package copergas
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/luisfelipemisi/knot/integration/knot/fileutil"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultScheduleFile = "internal/config/copergas_schedule.json"
+
+	// The schedule is written at most once per scheduleSaveInterval
+	scheduleSaveInterval = 10 * time.Second
+)
+
+// scheduledVariable is a variable waiting for its next read
+type scheduledVariable struct {
+	codVar   int
+	due      time.Time
+	interval time.Duration
+	// priority follows Prioridade, lower values are read first
+	priority int
+	index    int
+}
+
+// dueQueue orders the variables by the time they are due
+type dueQueue []*scheduledVariable
+
+func (q dueQueue) Len() int           { return len(q) }
+func (q dueQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q dueQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *dueQueue) Push(x interface{}) {
+	item := x.(*scheduledVariable)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+func (q *dueQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// readyQueue orders the variables already due by Prioridade, the lowest
+// first, then by the time they were due
+type readyQueue struct {
+	dueQueue
+}
+
+func (q readyQueue) Less(i, j int) bool {
+	if q.dueQueue[i].priority != q.dueQueue[j].priority {
+		return q.dueQueue[i].priority < q.dueQueue[j].priority
+	}
+	return q.dueQueue[i].due.Before(q.dueQueue[j].due)
+}
+
+// rateLimiter is a token bucket refilled every minute
+type rateLimiter struct {
+	perMinute int
+	tokens    float64
+	last      time.Time
+}
+
+// take spends a token, reporting how long to wait when there is none
+func (r *rateLimiter) take(now time.Time) (bool, time.Duration) {
+	if r.perMinute <= 0 {
+		return true, 0
+	}
+	rate := float64(r.perMinute) / float64(time.Minute)
+	r.tokens += float64(now.Sub(r.last)) * rate
+	if r.tokens > float64(r.perMinute) {
+		r.tokens = float64(r.perMinute)
+	}
+	r.last = now
+	if r.tokens >= 1 {
+		r.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - r.tokens) / rate)
+}
+
+// Scheduler reads each variable at its own IntervaloLeituraMin. When the
+// rate limit is reached, the due variables wait in Prioridade order.
+type Scheduler struct {
+	client      *Client
+	due         dueQueue
+	ready       readyQueue
+	limiter     rateLimiter
+	concurrency int
+	fallback    time.Duration
+	file        string
+	dirty       bool
+	log         *logrus.Entry
+	now         func() time.Time
+
+	// saved are the due times of the variables not scheduled, kept so a
+	// variable discovered later resumes where it stopped
+	saved map[int]time.Time
+
+	// reading are the variables being read, dropped is set when they are
+	// no longer read once they finish
+	reading map[int]bool
+	dropped map[int]bool
+
+	// variables replaces the variables read on the next loop
+	mu        sync.Mutex
+	variables []int
+	updated   chan struct{}
+}
+
+// NewScheduler constructs the scheduler of the pertinent variables,
+// resuming the next due times saved on the schedule file
+func NewScheduler(client *Client, conf entities.CopergasConfig, log *logrus.Entry) (*Scheduler, error) {
+	s := &Scheduler{
+		client:      client,
+		limiter:     rateLimiter{perMinute: conf.RateLimitPerMinute, tokens: float64(conf.RateLimitPerMinute)},
+		concurrency: conf.MaxConcurrentRequests,
+		fallback:    entities.Seconds(conf.TimeBetweenRequestsInSeconds, defaultPollInterval),
+		file:        conf.ScheduleFile,
+		log:         log,
+		reading:     make(map[int]bool),
+		dropped:     make(map[int]bool),
+		updated:     make(chan struct{}, 1),
+		now:         time.Now,
+	}
+	if s.concurrency <= 0 {
+		s.concurrency = defaultMaxConcurrentRequests
+	}
+	if s.file == "" {
+		s.file = defaultScheduleFile
+	}
+
+	var err error
+	s.saved, err = s.load()
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	s.limiter.last = now
+	for _, codVar := range conf.PertinentVariables {
+		heap.Push(&s.due, s.schedule(codVar, now))
+	}
+	return s, nil
+}
+
+// Run reads the variables as they are due, sending each one read on out,
+// until ctx is cancelled
+func (s *Scheduler) Run(ctx context.Context, out chan<- entities.Measurements) {
+	results := make(chan readResult)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	saveTicker := time.NewTicker(scheduleSaveInterval)
+	defer saveTicker.Stop()
+	defer s.saveChanges()
+
+	for {
+		items, wait := s.next(s.now())
+		for _, item := range items {
+			go s.read(ctx, item, results)
+		}
+		resetTimer(timer, wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.updated:
+			s.update()
+		case <-saveTicker.C:
+			s.saveChanges()
+		case result := <-results:
+			s.reschedule(result)
+			select {
+			case out <- entities.Measurements{Variables: map[int]entities.ReceivedData{result.received.CodVar: result.received}}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// next takes the variables to read at now, as many as the concurrency and
+// the rate limit allow, and returns how long to wait for the next one. It
+// waits forever, returning a negative duration, when nothing is scheduled.
+func (s *Scheduler) next(now time.Time) ([]*scheduledVariable, time.Duration) {
+	for s.due.Len() > 0 && !s.due[0].due.After(now) {
+		heap.Push(&s.ready, heap.Pop(&s.due))
+	}
+
+	var items []*scheduledVariable
+	wait := time.Duration(-1)
+	for s.ready.Len() > 0 && len(s.reading) < s.concurrency {
+		ok, retry := s.limiter.take(now)
+		if !ok {
+			wait = retry
+			break
+		}
+		item := heap.Pop(&s.ready).(*scheduledVariable)
+		s.reading[item.codVar] = true
+		items = append(items, item)
+	}
+	if wait < 0 && s.due.Len() > 0 && s.ready.Len() == 0 {
+		wait = s.due[0].due.Sub(now)
+	}
+	return items, wait
+}
+
+// SetVariables replaces the variables read, such as the ones discovered.
+// New variables are due at the time saved on the schedule file, or at once
+// when there is none.
+func (s *Scheduler) SetVariables(variables []int) {
+	s.mu.Lock()
+	s.variables = append([]int(nil), variables...)
+	s.mu.Unlock()
+
+	select {
+	case s.updated <- struct{}{}:
+	default:
+	}
+}
+
+// update applies the variables set, the reads already running finish
+func (s *Scheduler) update() {
+	s.mu.Lock()
+	variables := s.variables
+	s.mu.Unlock()
+
+	missing := make(map[int]bool, len(variables))
+	for _, codVar := range variables {
+		missing[codVar] = true
+	}
+	keep := func(queue dueQueue) dueQueue {
+		kept := queue[:0]
+		for _, item := range queue {
+			if missing[item.codVar] {
+				delete(missing, item.codVar)
+				kept = append(kept, item)
+			} else {
+				s.saved[item.codVar] = item.due
+			}
+		}
+		return kept
+	}
+	s.due = keep(s.due)
+	s.ready.dueQueue = keep(s.ready.dueQueue)
+	heap.Init(&s.due)
+	heap.Init(&s.ready)
+
+	s.dropped = make(map[int]bool)
+	for codVar := range s.reading {
+		if missing[codVar] {
+			delete(missing, codVar)
+		} else {
+			s.dropped[codVar] = true
+		}
+	}
+
+	now := s.now()
+	for _, codVar := range variables {
+		if missing[codVar] {
+			heap.Push(&s.due, s.schedule(codVar, now))
+		}
+	}
+	s.dirty = true
+}
+
+// schedule makes the variable due at its saved time, or at now
+func (s *Scheduler) schedule(codVar int, now time.Time) *scheduledVariable {
+	due, ok := s.saved[codVar]
+	if !ok {
+		due = now
+	}
+	delete(s.saved, codVar)
+	return &scheduledVariable{codVar: codVar, due: due, interval: s.fallback}
+}
+
+// readResult is a variable read with its schedule
+type readResult struct {
+	item     *scheduledVariable
+	received entities.ReceivedData
+}
+
+func (s *Scheduler) read(ctx context.Context, item *scheduledVariable, results chan<- readResult) {
+	variable, err := s.client.Variable(ctx, item.codVar)
+	if err != nil {
+		s.log.Errorln(err)
+	}
+	select {
+	case results <- readResult{item: item, received: entities.ReceivedData{CodVar: item.codVar, Error: err, Data: variable}}:
+	case <-ctx.Done():
+	}
+}
+
+// reschedule follows the interval and priority the variable reports
+func (s *Scheduler) reschedule(result readResult) {
+	item := result.item
+	delete(s.reading, item.codVar)
+	if s.dropped[item.codVar] {
+		delete(s.dropped, item.codVar)
+		return
+	}
+	if result.received.Error == nil {
+		variable := result.received.Data
+		item.priority = variable.Prioridade
+		item.interval = s.fallback
+		if variable.IntervaloLeituraMin > 0 {
+			item.interval = time.Duration(float64(variable.IntervaloLeituraMin) * float64(time.Minute))
+		}
+	}
+	item.due = s.now().Add(item.interval)
+	heap.Push(&s.due, item)
+	s.dirty = true
+}
+
+// saveChanges writes the schedule when it changed since the last write
+func (s *Scheduler) saveChanges() {
+	if !s.dirty {
+		return
+	}
+	if err := s.save(); err != nil {
+		s.log.Errorln(err)
+	}
+}
+
+func (s *Scheduler) load() (map[int]time.Time, error) {
+	saved := make(map[string]time.Time)
+	data, err := os.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return map[int]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading schedule: %w", err)
+	}
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding schedule: %w", err)
+	}
+
+	schedule := make(map[int]time.Time, len(saved))
+	for key, due := range saved {
+		codVar, err := strconv.Atoi(key)
+		if err == nil {
+			schedule[codVar] = due
+		}
+	}
+	return schedule, nil
+}
+
+// save writes the next due time of every variable, including the ones no
+// longer read. The ones being read are due again when the scheduler resumes.
+func (s *Scheduler) save() error {
+	schedule := make(map[string]time.Time, len(s.saved)+s.due.Len()+s.ready.Len())
+	for codVar, due := range s.saved {
+		schedule[strconv.Itoa(codVar)] = due
+	}
+	for _, item := range s.due {
+		schedule[strconv.Itoa(item.codVar)] = item.due
+	}
+	for _, item := range s.ready.dueQueue {
+		schedule[strconv.Itoa(item.codVar)] = item.due
+	}
+	data, err := json.MarshalIndent(schedule, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding schedule: %w", err)
+	}
+
+	err = fileutil.WriteAtomic(s.file, data)
+	if err != nil {
+		return fmt.Errorf("error writing schedule: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// resetTimer fires the timer after wait, or never when wait is negative
+func resetTimer(timer *time.Timer, wait time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	if wait >= 0 {
+		timer.Reset(wait)
+	}
+}
@@ -0,0 +1,197 @@
+package copergas
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// testClock is the time seen by a scheduler under test
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) add(d time.Duration) { c.now = c.now.Add(d) }
+
+// newTestScheduler builds a scheduler of the variables whose clock only
+// moves when the test moves it
+func newTestScheduler(t *testing.T, conf entities.CopergasConfig, variables ...int) (*Scheduler, *testClock) {
+	t.Helper()
+	conf.ScheduleFile = filepath.Join(t.TempDir(), "schedule.json")
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	s, err := NewScheduler(nil, conf, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &testClock{now: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)}
+	s.now = func() time.Time { return clock.now }
+	s.limiter.last = clock.now
+	s.SetVariables(variables)
+	<-s.updated
+	s.update()
+	return s, clock
+}
+
+// finish completes the read of the variable, which reports the priority and
+// interval given
+func finish(s *Scheduler, item *scheduledVariable, priority int, intervalMin float32) {
+	variable := entities.Variable{CodVar: item.codVar, Prioridade: priority, IntervaloLeituraMin: intervalMin}
+	s.reschedule(readResult{item: item, received: entities.ReceivedData{CodVar: item.codVar, Data: variable}})
+}
+
+func codVars(items []*scheduledVariable) []int {
+	vars := make([]int, 0, len(items))
+	for _, item := range items {
+		vars = append(vars, item.codVar)
+	}
+	sort.Ints(vars)
+	return vars
+}
+
+// scheduled returns when each variable waiting to be read is due
+func scheduled(s *Scheduler) map[int]time.Time {
+	due := make(map[int]time.Time)
+	for _, item := range append(append(dueQueue(nil), s.due...), s.ready.dueQueue...) {
+		due[item.codVar] = item.due
+	}
+	return due
+}
+
+func TestSchedulerReadsByPriority(t *testing.T) {
+	s, clock := newTestScheduler(t, entities.CopergasConfig{MaxConcurrentRequests: 3}, 1, 2, 3)
+
+	items, _ := s.next(clock.now)
+	if got := codVars(items); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Fatalf("read %v, want every variable", got)
+	}
+	// Variable 3 reports the lowest Prioridade, although it is due last
+	for _, item := range items {
+		clock.add(time.Second)
+		finish(s, item, 10-item.codVar, 1)
+	}
+
+	s.concurrency = 1
+	clock.add(2 * time.Minute)
+	for _, want := range []int{3, 2, 1} {
+		items, _ := s.next(clock.now)
+		if len(items) != 1 || items[0].codVar != want {
+			t.Fatalf("read %v, want variable %d", codVars(items), want)
+		}
+		finish(s, items[0], 10-want, 1)
+	}
+}
+
+func TestSchedulerFollowsInterval(t *testing.T) {
+	conf := entities.CopergasConfig{MaxConcurrentRequests: 2, TimeBetweenRequestsInSeconds: 30}
+	s, clock := newTestScheduler(t, conf, 1, 2)
+	start := clock.now
+
+	items, _ := s.next(clock.now)
+	for _, item := range items {
+		if item.codVar == 1 {
+			finish(s, item, 0, 2)
+			continue
+		}
+		// A failed read is due again after the configured interval
+		s.reschedule(readResult{item: item, received: entities.ReceivedData{CodVar: item.codVar, Error: errors.New("unavailable")}})
+	}
+	want := map[int]time.Time{1: start.Add(2 * time.Minute), 2: start.Add(30 * time.Second)}
+	if got := scheduled(s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("scheduled %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		after time.Duration
+		read  []int
+		wait  time.Duration
+	}{
+		{10 * time.Second, []int{}, 20 * time.Second},
+		{30 * time.Second, []int{2}, 90 * time.Second},
+		{time.Minute, []int{}, time.Minute},
+		{2 * time.Minute, []int{1}, 58*time.Minute + 30*time.Second},
+	}
+	for _, tt := range tests {
+		clock.now = start.Add(tt.after)
+		items, wait := s.next(clock.now)
+		if got := codVars(items); !reflect.DeepEqual(got, tt.read) || wait != tt.wait {
+			t.Errorf("after %v: read %v waiting %v, want %v waiting %v", tt.after, got, wait, tt.read, tt.wait)
+		}
+		for _, item := range items {
+			finish(s, item, 0, 60)
+		}
+	}
+}
+
+func TestSchedulerRateLimit(t *testing.T) {
+	conf := entities.CopergasConfig{MaxConcurrentRequests: 10, RateLimitPerMinute: 2}
+	s, clock := newTestScheduler(t, conf, 1, 2, 3)
+
+	items, wait := s.next(clock.now)
+	if len(items) != 2 || wait != 30*time.Second {
+		t.Fatalf("read %v waiting %v, want two variables waiting 30s", codVars(items), wait)
+	}
+
+	clock.add(10 * time.Second)
+	if items, _ := s.next(clock.now); len(items) != 0 {
+		t.Errorf("read %v before a token was refilled", codVars(items))
+	}
+
+	clock.add(20 * time.Second)
+	items, _ = s.next(clock.now)
+	if len(items) != 1 {
+		t.Errorf("read %v, want the last variable", codVars(items))
+	}
+}
+
+func TestSchedulerSetVariables(t *testing.T) {
+	s, clock := newTestScheduler(t, entities.CopergasConfig{MaxConcurrentRequests: 1}, 1, 2, 3)
+	start := clock.now
+
+	items, _ := s.next(clock.now)
+	if len(items) != 1 {
+		t.Fatalf("read %v, want one variable", codVars(items))
+	}
+	reading := items[0]
+
+	// Variable 4 was saved on the schedule file before it was discovered
+	s.saved[4] = start.Add(5 * time.Minute)
+	clock.add(time.Minute)
+	var kept []int
+	for _, codVar := range []int{1, 2, 3} {
+		if codVar != reading.codVar {
+			kept = append(kept, codVar)
+		}
+	}
+	s.SetVariables([]int{kept[0], 4, 5})
+	<-s.updated
+	s.update()
+
+	want := map[int]time.Time{
+		kept[0]: start,
+		4:       start.Add(5 * time.Minute),
+		5:       clock.now,
+	}
+	if got := scheduled(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("scheduled %v, want %v", got, want)
+	}
+	if due, ok := s.saved[kept[1]]; !ok || !due.Equal(start) {
+		t.Errorf("saved %v, want the removed variable %d kept", s.saved, kept[1])
+	}
+
+	// The read running when the variable was removed is not scheduled again
+	finish(s, reading, 0, 1)
+	if _, ok := scheduled(s)[reading.codVar]; ok {
+		t.Errorf("removed variable %d was scheduled again", reading.codVar)
+	}
+	if len(s.reading) != 0 {
+		t.Errorf("reading %v, want nothing", s.reading)
+	}
+}
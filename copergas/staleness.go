@@ -0,0 +1,128 @@
+package copergas
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// defaultStaleFactor is used when the stale factor is not configured
+const defaultStaleFactor = 3
+
+// StalenessEvent reports a variable whose reading is outdated
+type StalenessEvent struct {
+	CodVar      int
+	DataLeitura time.Time
+	Age         time.Duration
+	// Outdated is set when Copergas itself marks the variable outdated
+	Outdated bool
+}
+
+// Staleness keeps the last reading of each variable, so the same reading
+// fetched again is not published twice
+type Staleness struct {
+	mu       sync.Mutex
+	last     map[int]entities.VariableLastData
+	reported map[int]string
+	factor   float64
+	location *time.Location
+	codes    Codes
+	now      func() time.Time
+}
+
+// NewStaleness constructs the last-value cache. Dates are read on the
+// given location.
+func NewStaleness(conf entities.CopergasConfig, location *time.Location) *Staleness {
+	factor := float64(conf.StaleFactor)
+	if factor <= 0 {
+		factor = defaultStaleFactor
+	}
+	return &Staleness{
+		last:     make(map[int]entities.VariableLastData),
+		reported: make(map[int]string),
+		factor:   factor,
+		location: location,
+		codes:    NewCodes(conf.Codes),
+		now:      time.Now,
+	}
+}
+
+// Filter drops the variables whose DataLeitura did not advance since the
+// last cycle and reports the stale ones, once for each reading
+func (s *Staleness) Filter(measurements entities.Measurements) (entities.Measurements, []StalenessEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fresh := entities.Measurements{Variables: make(map[int]entities.ReceivedData, len(measurements.Variables))}
+	var events []StalenessEvent
+	now := s.now()
+	for codVar, received := range measurements.Variables {
+		if received.Error != nil {
+			fresh.Variables[codVar] = received
+			continue
+		}
+		variable := received.Data
+		read, err := parseDataLeitura(variable.DataLeitura, s.location)
+		if err != nil {
+			fresh.Variables[codVar] = received
+			continue
+		}
+
+		if event, ok := s.stale(variable, read, now); ok {
+			events = append(events, event)
+		}
+
+		last, seen := s.last[codVar]
+		if seen {
+			lastRead, err := parseDataLeitura(last.Timestamp, s.location)
+			if err == nil && !read.After(lastRead) {
+				continue
+			}
+		}
+		value, _ := s.codes.Decode(variable, s.location)
+		s.last[codVar] = entities.VariableLastData{Value: value, Timestamp: variable.DataLeitura}
+		fresh.Variables[codVar] = received
+	}
+	return fresh, events
+}
+
+// Last returns the last reading kept of the variable
+func (s *Staleness) Last(codVar int) (entities.VariableLastData, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, ok := s.last[codVar]
+	return last, ok
+}
+
+// stale checks the variable against its reading interval, reporting each
+// reading only once
+func (s *Staleness) stale(variable entities.Variable, read time.Time, now time.Time) (StalenessEvent, bool) {
+	if s.reported[variable.CodVar] == variable.DataLeitura {
+		return StalenessEvent{}, false
+	}
+
+	event := StalenessEvent{
+		CodVar:      variable.CodVar,
+		DataLeitura: read,
+		Age:         now.Sub(read),
+		Outdated:    outdated(variable.Desatualizado),
+	}
+	limit := time.Duration(s.factor * float64(variable.IntervaloLeituraMin) * float64(time.Minute))
+	if !event.Outdated && (limit <= 0 || event.Age <= limit) {
+		return StalenessEvent{}, false
+	}
+	s.reported[variable.CodVar] = variable.DataLeitura
+	return event, true
+}
+
+// outdated reads the Desatualizado flag sent by Copergas
+func outdated(desatualizado string) bool {
+	switch strings.ToLower(strings.TrimSpace(desatualizado)) {
+	case "s", "sim", "true", "1":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package copergas
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+func TestStalenessTransitions(t *testing.T) {
+	start := time.Date(2021, 3, 4, 5, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		now         time.Duration
+		dataLeitura string
+		outdated    string
+		published   bool
+		stale       time.Duration
+	}{
+		{"fresh", time.Minute, "2021-03-04T05:00:00", "", true, 0},
+		{"same reading, still fresh", 2 * time.Minute, "2021-03-04T05:00:00", "", false, 0},
+		{"becomes stale", 4 * time.Minute, "2021-03-04T05:00:00", "", false, 4 * time.Minute},
+		{"stays stale", 6 * time.Minute, "2021-03-04T05:00:00", "", false, 0},
+		{"recovers", 7 * time.Minute, "2021-03-04T05:06:00", "", true, 0},
+		{"stale again", 20 * time.Minute, "2021-03-04T05:06:00", "", false, 14 * time.Minute},
+		{"new reading marked outdated", 21 * time.Minute, "2021-03-04T05:20:00", "S", true, time.Minute},
+		{"outdated reading again", 22 * time.Minute, "2021-03-04T05:20:00", "S", false, 0},
+	}
+
+	s := NewStaleness(entities.CopergasConfig{StaleFactor: 3}, time.UTC)
+	var now time.Time
+	s.now = func() time.Time { return now }
+	for _, tt := range tests {
+		now = start.Add(tt.now)
+		variable := entities.Variable{
+			CodVar:              7,
+			CodTpDado:           defaultDataTypeInteger,
+			ValorInteger:        int(tt.now / time.Minute),
+			DataLeitura:         tt.dataLeitura,
+			IntervaloLeituraMin: 1,
+			Desatualizado:       tt.outdated,
+		}
+		fresh, events := s.Filter(entities.Measurements{Variables: map[int]entities.ReceivedData{7: {CodVar: 7, Data: variable}}})
+
+		if _, ok := fresh.Variables[7]; ok != tt.published {
+			t.Errorf("%s: published %v, want %v", tt.name, ok, tt.published)
+		}
+		if tt.stale == 0 {
+			if len(events) != 0 {
+				t.Errorf("%s: events %+v, want none", tt.name, events)
+			}
+			continue
+		}
+		if len(events) != 1 {
+			t.Fatalf("%s: events %+v, want one", tt.name, events)
+		}
+		event := events[0]
+		if event.CodVar != 7 || event.Age != tt.stale || event.Outdated != (tt.outdated != "") || event.DataLeitura.Format(dateTimeLayout) != tt.dataLeitura {
+			t.Errorf("%s: event %+v, want age %v", tt.name, event, tt.stale)
+		}
+	}
+
+	last, ok := s.Last(7)
+	if !ok || last.Timestamp != "2021-03-04T05:20:00" || last.Value != 21 {
+		t.Errorf("Last() = %+v, %v, want the outdated reading", last, ok)
+	}
+}
+
+func TestStalenessKeepsErrors(t *testing.T) {
+	s := NewStaleness(entities.CopergasConfig{}, time.UTC)
+	measurements := entities.Measurements{Variables: map[int]entities.ReceivedData{
+		7: {CodVar: 7, Error: errors.New("timeout")},
+		8: {CodVar: 8, Data: entities.Variable{CodVar: 8, DataLeitura: "not a date"}},
+	}}
+
+	fresh, events := s.Filter(measurements)
+	if len(fresh.Variables) != 2 || len(events) != 0 {
+		t.Errorf("Filter() = %+v, %+v, want both variables passed on", fresh, events)
+	}
+}
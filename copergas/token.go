@@ -0,0 +1,69 @@
+package copergas
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// Tokens are renewed when less than tokenRefreshMargin of their life is left
+const tokenRefreshMargin = time.Minute
+
+// expiresLayouts are the layouts accepted on Token.ExpiresUtc
+var expiresLayouts = []string{
+	http.TimeFormat,
+	time.RFC1123,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+}
+
+// tokenCache keeps the access token until it is about to expire
+type tokenCache struct {
+	mu      sync.Mutex
+	token   entities.Token
+	expires time.Time
+	now     func() time.Time
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{now: time.Now}
+}
+
+// get returns the cached token, logging in when there is none or it is
+// about to expire. Concurrent callers wait for a single login.
+func (t *tokenCache) get(ctx context.Context, login func(context.Context) (entities.Token, error)) (entities.Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token.AccessToken != "" && t.now().Add(tokenRefreshMargin).Before(t.expires) {
+		return t.token, nil
+	}
+
+	token, err := login(ctx)
+	if err != nil {
+		return entities.Token{}, err
+	}
+	t.token = token
+	t.expires = tokenExpiry(token, t.now())
+	return token, nil
+}
+
+// invalidate drops the cached token so the next call logs in again
+func (t *tokenCache) invalidate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.token = entities.Token{}
+}
+
+// tokenExpiry reads ExpiresUtc, falling back to ExpiresIn seconds from now
+func tokenExpiry(token entities.Token, now time.Time) time.Time {
+	for _, layout := range expiresLayouts {
+		if expires, err := time.Parse(layout, token.ExpiresUtc); err == nil {
+			return expires
+		}
+	}
+	return now.Add(time.Duration(token.ExpiresIn * float32(time.Second)))
+}
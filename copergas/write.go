@@ -0,0 +1,170 @@
+package copergas
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// Defaults used when the write polling is not configured
+const (
+	defaultWritePollInterval = 2 * time.Second
+	defaultWriteTimeout      = time.Minute
+
+	dateTimeLayout = "2006-01-02T15:04:05"
+)
+
+// WriteError reports a write the Copergas station did not execute
+type WriteError struct {
+	CodVar int
+	Code   int
+	Status string
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("write of variable %d failed with status %d: %s", e.CodVar, e.Code, e.Status)
+}
+
+// writeRequest carries only the write fields of a variable, so the fields
+// changed on Copergas since the variable was read are left as they are
+type writeRequest struct {
+	CodVar            int     `json:"codVar"`
+	CodTpDadoEscr     int     `json:"codTpDadoEscr"`
+	CodStExecEscr     int     `json:"codStExecEscr"`
+	ValorIntegerEscr  int     `json:"ValorIntegerEscr"`
+	ValorFloatEscr    float32 `json:"ValorFloatEscr"`
+	ValorStringEscr   string  `json:"ValorStringEscr"`
+	ValorDateTimeEscr string  `json:"ValorDateTimeEscr"`
+}
+
+// Write sets the value of the variable and waits until the station reports
+// the write was executed
+func (c *Client) Write(ctx context.Context, codVar int, value interface{}) error {
+	timeout := entities.Seconds(c.conf.Write.TimeoutInSeconds, defaultWriteTimeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	variable, err := c.Variable(ctx, codVar)
+	if err != nil {
+		return err
+	}
+	request, err := c.codes.writeRequest(variable, value)
+	if err != nil {
+		return fmt.Errorf("variable %d: %w", codVar, err)
+	}
+
+	err = c.do(ctx, http.MethodPut, c.conf.Endpoints.Write, &request, nil)
+	if err != nil {
+		return fmt.Errorf("error writing variable %d: %w", codVar, err)
+	}
+	return c.waitWrite(ctx, codVar)
+}
+
+// waitWrite polls the variable until its write status is final, logging
+// each new status
+func (c *Client) waitWrite(ctx context.Context, codVar int) error {
+	ticker := time.NewTicker(entities.Seconds(c.conf.Write.PollIntervalInSeconds, defaultWritePollInterval))
+	defer ticker.Stop()
+
+	status := c.codes.writePending
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("error waiting write of variable %d: %w", codVar, ctx.Err())
+		case <-ticker.C:
+		}
+
+		variable, err := c.Variable(ctx, codVar)
+		if err != nil {
+			return err
+		}
+		if variable.CodStExecEscr != status {
+			status = variable.CodStExecEscr
+			c.log.Printf("write of variable %d: %d %s", codVar, status, variable.StatusEscrita)
+		}
+		if status == c.codes.writeDone {
+			return nil
+		}
+		if !c.codes.writeRunning[status] {
+			return &WriteError{CodVar: codVar, Code: status, Status: variable.StatusEscrita}
+		}
+	}
+}
+
+// writeRequest builds the write of the value on the field matching the
+// variable data type
+func (c Codes) writeRequest(variable entities.Variable, value interface{}) (writeRequest, error) {
+	request := writeRequest{
+		CodVar:        variable.CodVar,
+		CodTpDadoEscr: variable.CodTpDado,
+		CodStExecEscr: c.writePending,
+	}
+
+	switch kind := c.kind(variable); kind {
+	case kindInteger, kindBit:
+		number, ok := toInt(value)
+		if !ok {
+			return request, fmt.Errorf("value %v is not an integer", value)
+		}
+		if kind == kindBit && number != 0 && number != 1 {
+			return request, fmt.Errorf("value %v is not a bit", value)
+		}
+		request.ValorIntegerEscr = number
+	case kindFloat:
+		number, ok := parseNumber(value)
+		if !ok {
+			return request, fmt.Errorf("value %v is not a number", value)
+		}
+		request.ValorFloatEscr = float32(number)
+	case kindString:
+		request.ValorStringEscr = fmt.Sprint(value)
+	case kindDateTime:
+		text, ok := value.(string)
+		if !ok {
+			return request, fmt.Errorf("value %v is not a date", value)
+		}
+		date, err := time.Parse(time.RFC3339, text)
+		if err != nil {
+			date, err = time.Parse(dateTimeLayout, text)
+		}
+		if err != nil {
+			return request, fmt.Errorf("value %v is not a date", value)
+		}
+		request.ValorDateTimeEscr = date.Format(dateTimeLayout)
+	default:
+		return request, fmt.Errorf("unknown data type %d", variable.CodTpDado)
+	}
+	return request, nil
+}
+
+func toInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		number, err := strconv.Atoi(strings.TrimSpace(v))
+		return number, err == nil
+	}
+	number, ok := entities.ToFloat(value)
+	if !ok || number != float64(int(number)) {
+		return 0, false
+	}
+	return int(number), true
+}
+
+// parseNumber reads the numbers that come from JSON or as text
+func parseNumber(value interface{}) (float64, bool) {
+	if text, ok := value.(string); ok {
+		number, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		return number, err == nil
+	}
+	return entities.ToFloat(value)
+}
@@ -0,0 +1,176 @@
+package copergas
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeStation stands in for the Copergas API of a station executing writes,
+// answering each read of the variable with the next write status
+type fakeStation struct {
+	mu       sync.Mutex
+	variable entities.Variable
+	statuses []int
+	writes   []map[string]interface{}
+}
+
+func (f *fakeStation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/token":
+		json.NewEncoder(w).Encode(entities.Token{AccessToken: "token"})
+	case "/variable/7":
+		variable := f.variable
+		if len(f.writes) > 0 && len(f.statuses) > 0 {
+			variable.CodStExecEscr = f.statuses[0]
+			variable.StatusEscrita = "status"
+			if len(f.statuses) > 1 {
+				f.statuses = f.statuses[1:]
+			}
+		}
+		json.NewEncoder(w).Encode(variable)
+	case "/write":
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var write map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&write)
+		f.writes = append(f.writes, write)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newWriteClient builds a client of the fake station polling the write
+// status every few milliseconds
+func newWriteClient(t *testing.T, station *fakeStation, timeoutInSeconds float32) *Client {
+	t.Helper()
+	server := httptest.NewServer(station)
+	t.Cleanup(server.Close)
+
+	conf := entities.CopergasConfig{}
+	conf.Endpoints.AuthToken = "/token"
+	conf.Endpoints.Variable = "/variable/"
+	conf.Endpoints.Write = "/write"
+	conf.Write.PollIntervalInSeconds = 0.005
+	conf.Write.TimeoutInSeconds = timeoutInSeconds
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	return NewClient(conf, logrus.NewEntry(log), WithBaseURL(server.URL), WithHTTPClient(server.Client()))
+}
+
+func TestWriteDone(t *testing.T) {
+	station := &fakeStation{
+		variable: entities.Variable{CodVar: 7, CodTpDado: defaultDataTypeFloat, Descricao: "pressure", ValorFloat: 1},
+		statuses: []int{defaultWritePending, defaultWriteRunning, defaultWriteRunning, defaultWriteDone},
+	}
+	c := newWriteClient(t, station, 5)
+
+	if err := c.Write(context.Background(), 7, "2.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(station.writes) != 1 {
+		t.Fatalf("writes = %v, want one", station.writes)
+	}
+	write := station.writes[0]
+	want := map[string]interface{}{
+		"codVar":            7.0,
+		"codTpDadoEscr":     float64(defaultDataTypeFloat),
+		"codStExecEscr":     float64(defaultWritePending),
+		"ValorIntegerEscr":  0.0,
+		"ValorFloatEscr":    2.5,
+		"ValorStringEscr":   "",
+		"ValorDateTimeEscr": "",
+	}
+	if len(write) != len(want) {
+		t.Errorf("write = %v, want only the write fields %v", write, want)
+	}
+	for key, value := range want {
+		if write[key] != value {
+			t.Errorf("write[%q] = %v, want %v", key, write[key], value)
+		}
+	}
+}
+
+func TestWriteFailed(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    entities.CopergasCodes
+		statuses []int
+		code     int
+	}{
+		{"failed", entities.CopergasCodes{}, []int{defaultWriteRunning, 4}, 4},
+		{"cancelled", entities.CopergasCodes{}, []int{0}, 0},
+		{"unknown status", entities.CopergasCodes{}, []int{9}, 9},
+		{"configured running status", entities.CopergasCodes{WriteRunning: []int{5}}, []int{5, 5, defaultWriteRunning}, defaultWriteRunning},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			station := &fakeStation{
+				variable: entities.Variable{CodVar: 7, CodTpDado: defaultDataTypeInteger},
+				statuses: tt.statuses,
+			}
+			c := newWriteClient(t, station, 5)
+			c.codes = NewCodes(tt.codes)
+
+			err := c.Write(context.Background(), 7, 3)
+			var writeErr *WriteError
+			if !errors.As(err, &writeErr) {
+				t.Fatalf("err = %v, want a WriteError", err)
+			}
+			if writeErr.CodVar != 7 || writeErr.Code != tt.code || writeErr.Status != "status" {
+				t.Errorf("err = %+v, want status %d", writeErr, tt.code)
+			}
+		})
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	station := &fakeStation{
+		variable: entities.Variable{CodVar: 7, CodTpDado: defaultDataTypeInteger},
+		statuses: []int{defaultWriteRunning},
+	}
+	c := newWriteClient(t, station, 0.05)
+
+	err := c.Write(context.Background(), 7, 3)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the deadline exceeded", err)
+	}
+}
+
+func TestWriteInvalidValue(t *testing.T) {
+	tests := []struct {
+		dataType int
+		value    interface{}
+	}{
+		{defaultDataTypeInteger, "many"},
+		{defaultDataTypeBit, 2},
+		{defaultDataTypeFloat, "much"},
+		{defaultDataTypeDateTime, "yesterday"},
+		{99, 1},
+	}
+	for _, tt := range tests {
+		station := &fakeStation{variable: entities.Variable{CodVar: 7, CodTpDado: tt.dataType}}
+		c := newWriteClient(t, station, 5)
+
+		if err := c.Write(context.Background(), 7, tt.value); err == nil {
+			t.Errorf("Write(%v) on data type %d succeeded, want an error", tt.value, tt.dataType)
+		}
+		if len(station.writes) != 0 {
+			t.Errorf("writes = %v, want none", station.writes)
+		}
+	}
+}
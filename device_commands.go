@@ -0,0 +1,124 @@
+package knot
+
+import (
+	"fmt"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// commandKind identifies a change to the device map requested at runtime
+type commandKind int
+
+const (
+	commandAdd commandKind = iota
+	commandRemove
+	commandUpdateConfig
+)
+
+// deviceCommand is a change to the device map requested through the
+// integration, it runs on the control routine so the map has a single writer
+type deviceCommand struct {
+	kind   commandKind
+	device entities.Device
+	result chan error
+}
+
+// Run the command on the device map
+func (p *protocol) runCommand(command deviceCommand) error {
+	switch command.kind {
+	case commandAdd:
+		return p.addDevice(command.device)
+	case commandRemove:
+		return p.removeDevice(command.device.ID)
+	case commandUpdateConfig:
+		return p.updateDeviceConfig(command.device.ID, command.device.Config)
+	}
+	return fmt.Errorf("unknown device command %d", command.kind)
+}
+
+// Add a device and start its lifecycle
+func (p *protocol) addDevice(device entities.Device) error {
+	if p.deviceExists(device) {
+		return fmt.Errorf("device %s already exists", device.ID)
+	}
+	if device.Config != nil {
+		if err := p.checkDeviceConfiguration(device); err != nil {
+			return err
+		}
+	}
+
+	device.State = ""
+	device.Data = nil
+	device.Error = ""
+	if err := p.createDevice(device); err != nil {
+		return err
+	}
+	p.shareDevices()
+
+	device, _ = p.registry.Get(device.ID)
+	_, err := p.machine.update(p, device)
+	return err
+}
+
+// Unregister a device from Knot Cloud and forget it
+func (p *protocol) removeDevice(id string) error {
+	device, ok := p.registry.Get(id)
+	if !ok {
+		return fmt.Errorf("Device do not exist")
+	}
+
+	p.timers.forget(id)
+	p.requests.drop(id)
+	if device.Token != "" {
+		correlationID, err := p.requests.add(id, kindUnregister)
+		if err == nil {
+			err = p.network.publisher.PublishDeviceUnregister(p.userToken, &device, correlationID)
+		}
+		if err != nil {
+			p.requests.drop(id)
+			return err
+		}
+		p.log.Println("send a unregister request")
+	}
+
+	if err := p.deleteDevice(id); err != nil {
+		return err
+	}
+	verifyErrors(p.buffer.clear(id), p.log)
+	p.events.forget(id)
+	p.unsubscribeCommands(id)
+	p.shareDevices()
+	return nil
+}
+
+// Replace the device configuration, sending it again to Knot Cloud when
+// the device already went through the configuration step
+func (p *protocol) updateDeviceConfig(id string, config []entities.Config) error {
+	device, ok := p.registry.Get(id)
+	if !ok {
+		return fmt.Errorf("Device do not exist")
+	}
+	device.Config = config
+	if err := p.checkDeviceConfiguration(device); err != nil {
+		return err
+	}
+
+	p.setDevice(device)
+	if device.State != entities.KnotPublishing {
+		return nil
+	}
+	_, err := p.machine.fire(p, device, entities.KnotAuth)
+	return err
+}
+
+// Copy of the device map as it is written to the config file, devices
+// restart their lifecycle when loaded again
+func (p *protocol) persistedDevices() map[string]entities.Device {
+	devices := p.registry.Snapshot()
+	for id, device := range devices {
+		device.State = entities.KnotNew
+		device.Data = nil
+		devices[id] = device
+	}
+	return devices
+}
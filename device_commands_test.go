@@ -0,0 +1,184 @@
+package knot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+func sensorConfig(sensorID int, name string) []entities.Config {
+	return []entities.Config{{
+		SensorID: sensorID,
+		Schema:   entities.Schema{ValueType: entities.ValueTypeFloat, Unit: 1, TypeID: 0x000A, Name: name},
+	}}
+}
+
+func TestAddDevice(t *testing.T) {
+	stored := entities.Device{ID: "0000000000000001", Name: "meter", Config: sensorConfig(1, "flow"), State: entities.KnotPublishing}
+	tests := []struct {
+		name   string
+		device entities.Device
+		added  bool
+		sent   []string
+	}{
+		{
+			name:   "new device registers",
+			device: entities.Device{ID: "0000000000000002", Name: "station", Config: sensorConfig(1, "flow"), State: entities.KnotPublishing},
+			added:  true,
+			sent:   []string{"register 0000000000000002"},
+		},
+		{
+			name:   "known device is refused",
+			device: entities.Device{ID: stored.ID, Name: "other", Config: sensorConfig(1, "flow")},
+		},
+		{
+			name:   "invalid config is refused",
+			device: entities.Device{ID: "0000000000000002", Name: "station", Config: []entities.Config{{SensorID: 1, Schema: entities.Schema{TypeID: 0xFF10}}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, publisher := newTestProtocol(t, stored)
+
+			err := p.runCommand(deviceCommand{kind: commandAdd, device: tt.device})
+			if (err == nil) != tt.added {
+				t.Fatalf("err = %v, want added %v", err, tt.added)
+			}
+			device, ok := p.registry.Get(tt.device.ID)
+			if tt.added && (!ok || device.State != entities.KnotWaitReg) {
+				t.Errorf("stored device = %+v, want it waiting for registration", device)
+			}
+			if !tt.added && ok && device.Name != stored.Name {
+				t.Errorf("stored device = %+v, want it unchanged", device)
+			}
+			if !reflect.DeepEqual(publisher.sent, tt.sent) {
+				t.Errorf("sent %v, want %v", publisher.sent, tt.sent)
+			}
+		})
+	}
+}
+
+func TestIntegrationAddDeviceReturnsGeneratedID(t *testing.T) {
+	p, publisher := newTestProtocol(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	integration := &Integration{commandChan: make(chan deviceCommand), ctx: ctx, cancel: cancel}
+	// Stand in for the control routine
+	go func() {
+		command := <-integration.commandChan
+		command.result <- p.runCommand(command)
+	}()
+
+	id, err := integration.AddDevice(entities.Device{Name: "meter", Config: sensorConfig(1, "flow")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("AddDevice() returned no ID")
+	}
+	if _, ok := p.registry.Get(id); !ok {
+		t.Errorf("device %s was not stored", id)
+	}
+	if !reflect.DeepEqual(publisher.sent, []string{"register " + id}) {
+		t.Errorf("sent %v, want a register of %s", publisher.sent, id)
+	}
+}
+
+func TestRemoveDevice(t *testing.T) {
+	tests := []struct {
+		name   string
+		device entities.Device
+		sent   []string
+	}{
+		{
+			name:   "registered device unregisters",
+			device: entities.Device{ID: "0000000000000001", Token: "token", Name: "meter", State: entities.KnotPublishing},
+			sent:   []string{"unregister 0000000000000001"},
+		},
+		{
+			name:   "device with no token is only forgotten",
+			device: entities.Device{ID: "0000000000000001", Name: "meter", State: entities.KnotWaitReg},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, publisher := newTestProtocol(t, tt.device)
+
+			err := p.runCommand(deviceCommand{kind: commandRemove, device: entities.Device{ID: tt.device.ID}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := p.registry.Get(tt.device.ID); ok {
+				t.Error("device is still stored")
+			}
+			if !reflect.DeepEqual(publisher.sent, tt.sent) {
+				t.Errorf("sent %v, want %v", publisher.sent, tt.sent)
+			}
+		})
+	}
+
+	p, _ := newTestProtocol(t)
+	if err := p.runCommand(deviceCommand{kind: commandRemove, device: entities.Device{ID: "0000000000000001"}}); err == nil {
+		t.Error("removing an unknown device succeeded")
+	}
+}
+
+func TestUpdateDeviceConfigWhilePublishing(t *testing.T) {
+	device := entities.Device{ID: "0000000000000001", Token: "token", Name: "meter", Config: sensorConfig(1, "flow"), State: entities.KnotPublishing}
+	p, publisher := newTestProtocol(t, device)
+
+	config := sensorConfig(2, "pressure")
+	err := p.runCommand(deviceCommand{kind: commandUpdateConfig, device: entities.Device{ID: device.ID, Config: config}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := p.registry.Get(device.ID)
+	if stored.State != entities.KnotWaitConfig {
+		t.Errorf("state = %q, want %q", stored.State, entities.KnotWaitConfig)
+	}
+	if !reflect.DeepEqual(publisher.configs, [][]entities.Config{config}) {
+		t.Errorf("sent configs %v, want %v", publisher.configs, config)
+	}
+}
+
+func TestUpdateDeviceConfigBeforePublishing(t *testing.T) {
+	device := entities.Device{ID: "0000000000000001", Token: "token", Name: "meter", Config: sensorConfig(1, "flow"), State: entities.KnotWaitAuth}
+	p, publisher := newTestProtocol(t, device)
+
+	config := sensorConfig(2, "pressure")
+	err := p.runCommand(deviceCommand{kind: commandUpdateConfig, device: entities.Device{ID: device.ID, Config: config}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := p.registry.Get(device.ID)
+	if stored.State != entities.KnotWaitAuth || !reflect.DeepEqual(stored.Config, config) {
+		t.Errorf("stored device = %+v, want the new config waiting for authentication", stored)
+	}
+	if len(publisher.sent) != 0 {
+		t.Fatalf("sent %v, want nothing before the device is authenticated", publisher.sent)
+	}
+
+	// The config step sends the stored config once the device authenticates
+	if _, err := p.machine.fire(p, stored, entities.KnotAuth); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(publisher.configs, [][]entities.Config{config}) {
+		t.Errorf("sent configs %v, want %v", publisher.configs, config)
+	}
+}
+
+func TestUpdateDeviceConfigInvalid(t *testing.T) {
+	device := entities.Device{ID: "0000000000000001", Token: "token", Name: "meter", Config: sensorConfig(1, "flow"), State: entities.KnotWaitAuth}
+	p, _ := newTestProtocol(t, device)
+
+	err := p.runCommand(deviceCommand{kind: commandUpdateConfig, device: entities.Device{ID: device.ID}})
+	if err == nil {
+		t.Fatal("an empty config was accepted")
+	}
+	stored, _ := p.registry.Get(device.ID)
+	if !reflect.DeepEqual(stored.Config, device.Config) {
+		t.Errorf("config = %v, want it unchanged", stored.Config)
+	}
+}
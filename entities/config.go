@@ -1,5 +1,7 @@
 package entities
 
+import "time"
+
 // Config represents the thing's config
 type Config struct {
 	SensorID int    `yaml:"sensorId"`
@@ -16,9 +18,110 @@ type CopergasConfig struct {
 		APIUrl    string `yaml:"APIUrl"`
 		AuthToken string `yaml:"authToken"`
 		Variable  string `yaml:"variable"`
+		Write     string `yaml:"write"`
+		// Variables lists the variables of a station, meter or company
+		Variables string `yaml:"variables"`
 	}
-	PertinentVariables []int  `yaml:"pertinentVariables"`
-	LogFilename        string `yaml:"logFilename"`
+	PertinentVariables []int           `yaml:"pertinentVariables"`
+	Discovery          DiscoveryConfig `yaml:"discovery"`
+	LogFilename        string          `yaml:"logFilename"`
 
 	TimeBetweenRequestsInSeconds float32 `yaml:"timeBetweenRequestsInSeconds"`
+	// At most MaxConcurrentRequests variables are read at the same time
+	MaxConcurrentRequests int `yaml:"maxConcurrentRequests"`
+	// A reading older than StaleFactor times IntervaloLeituraMin is stale
+	StaleFactor float32 `yaml:"staleFactor"`
+	// RateLimitPerMinute caps the requests to the Copergas API, no limit when zero
+	RateLimitPerMinute int `yaml:"rateLimitPerMinute"`
+	// ScheduleFile keeps when each variable is due, so polling resumes
+	// where it stopped after a restart
+	ScheduleFile string `yaml:"scheduleFile"`
+	Write        struct {
+		// The variable is read every poll interval until the write finishes
+		PollIntervalInSeconds float32 `yaml:"pollIntervalInSeconds"`
+		TimeoutInSeconds      float32 `yaml:"timeoutInSeconds"`
+	} `yaml:"write"`
+	Codes CopergasCodes `yaml:"codes"`
+}
+
+// CopergasCodes represents the codes the Copergas API gives the data types,
+// on CodTpDado and CodTpDadoEscr, and the write status, on CodStExecEscr.
+// The codes left at zero keep their defaults.
+type CopergasCodes struct {
+	Integer  int `yaml:"integer"`
+	Float    int `yaml:"float"`
+	String   int `yaml:"string"`
+	DateTime int `yaml:"dateTime"`
+	Bit      int `yaml:"bit"`
+	// WritePending is sent with a write, WriteRunning are reported while the
+	// station runs it and WriteDone once it succeeds. Any other status ends
+	// the write as failed.
+	WritePending int   `yaml:"writePending"`
+	WriteRunning []int `yaml:"writeRunning"`
+	WriteDone    int   `yaml:"writeDone"`
+}
+
+// DiscoveryConfig represents the rules choosing the variables read when they
+// are discovered instead of listed on PertinentVariables
+type DiscoveryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Variables of these stations, meters and companies are listed
+	Stations  []int `yaml:"stations"`
+	Meters    []int `yaml:"meters"`
+	Companies []int `yaml:"companies"`
+	// Only variables with FazerTelemetria or GravarHistorico set are kept
+	TelemetryOnly bool `yaml:"telemetryOnly"`
+	HistoryOnly   bool `yaml:"historyOnly"`
+	// TagPatterns are shell patterns matched against TagWeb
+	TagPatterns []string `yaml:"tagPatterns"`
+	// Description is a regular expression matched against Descricao
+	Description       string  `yaml:"description"`
+	IntervalInSeconds float32 `yaml:"intervalInSeconds"`
+}
+
+// KnotConfig represents the settings of the Knot protocol handling
+type KnotConfig struct {
+	// QueueName must differ between instances, when empty each instance
+	// gets a queue of its own named by the broker
+	QueueName string      `yaml:"queueName"`
+	Store     StoreConfig `yaml:"store"`
+	// Changes to the devices are written to the store at most once per interval
+	PersistIntervalInSeconds float32      `yaml:"persistIntervalInSeconds"`
+	Buffer                   BufferConfig `yaml:"buffer"`
+	Timeouts                 struct {
+		Register StepTimeout `yaml:"register"`
+		Auth     StepTimeout `yaml:"auth"`
+		Config   StepTimeout `yaml:"config"`
+	} `yaml:"timeouts"`
+}
+
+// StoreConfig represents where the device registry is persisted
+type StoreConfig struct {
+	// Kind is "yaml" for a single file or "bolt" for an embedded bbolt database
+	Kind string `yaml:"kind"`
+	Path string `yaml:"path"`
+}
+
+// BufferConfig represents the disk buffer of the readings waiting to be published
+type BufferConfig struct {
+	Dir             string  `yaml:"dir"`
+	MaxReadings     int     `yaml:"maxReadings"`
+	MaxAgeInSeconds float32 `yaml:"maxAgeInSeconds"`
+}
+
+// StepTimeout represents how long to wait for the response of a request and
+// how many times it is sent before giving up
+type StepTimeout struct {
+	TimeoutInSeconds    float32 `yaml:"timeoutInSeconds"`
+	MaxTimeoutInSeconds float32 `yaml:"maxTimeoutInSeconds"`
+	Multiplier          float32 `yaml:"multiplier"`
+	MaxAttempts         int     `yaml:"maxAttempts"`
+}
+
+// Seconds converts a duration set in seconds, using fallback when it is not set
+func Seconds(value float32, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
+	}
+	return time.Duration(float64(value) * float64(time.Second))
 }
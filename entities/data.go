@@ -6,3 +6,24 @@ type Data struct {
 	Value     interface{} `json:"value"`
 	TimeStamp interface{} `json:"timestamp"`
 }
+
+// ToFloat converts the numeric values that come from YAML and JSON
+func ToFloat(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int:
+		return float64(number), true
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case uint:
+		return float64(number), true
+	case uint64:
+		return float64(number), true
+	case float32:
+		return float64(number), true
+	case float64:
+		return number, true
+	}
+	return 0, false
+}
@@ -1,19 +1,23 @@
 package entities
 
+// State represents the current status of the device on the Knot network
+type State string
+
 // States that represent the current status of the device on the Knot network
 const (
-	KnotNew         string = "new"
-	KnotAlreadyReg  string = "alreadyRegistered"
-	KnotRegistered  string = "registered"
-	KnotForceDelete string = "forceDelete"
-	KnotReady       string = "readyToSendData"
-	KnotPublishing  string = "SendData"
-	KnotAuth        string = "authenticated"
-	KnotError       string = "error"
-	KnotWaitReg     string = "waitResponseRegister"
-	KnotWaitAuth    string = "waitResponseAuth"
-	KnotWaitConfig  string = "waitResponseConfig"
-	KnotOff         string = "ignore"
+	KnotNew         State = "new"
+	KnotAlreadyReg  State = "alreadyRegistered"
+	KnotRegistered  State = "registered"
+	KnotForceDelete State = "forceDelete"
+	KnotReady       State = "readyToSendData"
+	KnotPublishing  State = "SendData"
+	KnotAuth        State = "authenticated"
+	KnotError       State = "error"
+	KnotWaitReg     State = "waitResponseRegister"
+	KnotWaitAuth    State = "waitResponseAuth"
+	KnotWaitConfig  State = "waitResponseConfig"
+	KnotQuarantine  State = "quarantine"
+	KnotOff         State = "ignore"
 )
 
 // Device represents the device domain entity
@@ -23,7 +27,7 @@ type Device struct {
 	Token  string   `yaml:"token"`
 	Name   string   `yaml:"name"`
 	Config []Config `yaml:"config"`
-	State  string   `yaml:"state"`
+	State  State    `yaml:"state"`
 	Data   []Data   `yaml:"data"`
 	Error  string
 
@@ -0,0 +1,43 @@
+package entities
+
+// MappingConfig represents the rules turning Copergas variables into KNoT things
+type MappingConfig struct {
+	// GroupBy is "meter" to make a thing of each CodMed or "station" for each CodEst
+	GroupBy string `yaml:"groupBy"`
+	// TimeZone of DataLeitura, the local time zone when empty
+	TimeZone string `yaml:"timeZone"`
+	// Units maps a Copergas Unidade to a schema such as "temperature/celsius/float"
+	Units map[string]string `yaml:"units"`
+	// Groups names the affiliation groups by CodAgr
+	Groups  map[int]string  `yaml:"groups"`
+	Devices []DeviceMapping `yaml:"devices"`
+}
+
+// DeviceMapping represents the settings of the thing made of a station or meter
+type DeviceMapping struct {
+	CodEst  int             `yaml:"codEst"`
+	CodMed  int             `yaml:"codMed"`
+	Name    string          `yaml:"name"`
+	Sensors []SensorMapping `yaml:"sensors"`
+}
+
+// SensorMapping represents the settings of the sensor made of a variable
+type SensorMapping struct {
+	CodVar   int    `yaml:"codVar"`
+	SensorID *int   `yaml:"sensorId"`
+	Name     string `yaml:"name"`
+	// Schema replaces the one derived from the variable unit
+	Schema string       `yaml:"schema"`
+	Alarm  AlarmMapping `yaml:"alarm"`
+}
+
+// AlarmMapping represents the thresholds of the alarm levels enabled on a
+// variable, the Copergas API only tells which levels are enabled
+type AlarmMapping struct {
+	VeryHigh *float64 `yaml:"veryHigh"`
+	High     *float64 `yaml:"high"`
+	Low      *float64 `yaml:"low"`
+	VeryLow  *float64 `yaml:"veryLow"`
+	// SensorID of the sensor publishing EmAlarmeNivel
+	SensorID *int `yaml:"sensorId"`
+}
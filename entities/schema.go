@@ -1,5 +1,13 @@
 package entities
 
+// Value types of the thing's schema
+const (
+	ValueTypeInt   = 1
+	ValueTypeFloat = 2
+	ValueTypeBool  = 3
+	ValueTypeRaw   = 4
+)
+
 // Schema represents the thing's schema
 type Schema struct {
 	ValueType int    `yaml:"valueType"`
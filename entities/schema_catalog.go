@@ -0,0 +1,139 @@
+package entities
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SchemaType describes a KNoT type ID with the units and value types it accepts
+type SchemaType struct {
+	ID         int
+	Name       string
+	Units      map[int]string
+	ValueTypes []int
+}
+
+// SchemaError reports a schema field that does not match the catalog
+type SchemaError struct {
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Field, e.Value, e.Reason)
+}
+
+// ValueTypeNames names the value types of the schema
+var ValueTypeNames = map[int]string{
+	ValueTypeInt:   "int",
+	ValueTypeFloat: "float",
+	ValueTypeBool:  "bool",
+	ValueTypeRaw:   "raw",
+}
+
+var numeric = []int{ValueTypeInt, ValueTypeFloat}
+
+// SchemaTypes is the catalog of the KNoT type IDs
+var SchemaTypes = []SchemaType{
+	{0x0000, "none", map[int]string{0: "none"}, []int{ValueTypeInt, ValueTypeFloat, ValueTypeBool, ValueTypeRaw}},
+	{0x0001, "voltage", map[int]string{1: "volt", 2: "millivolt", 3: "kilovolt"}, numeric},
+	{0x0002, "current", map[int]string{1: "ampere", 2: "milliampere"}, numeric},
+	{0x0003, "resistance", map[int]string{1: "ohm"}, numeric},
+	{0x0004, "power", map[int]string{1: "watt", 2: "kilowatt", 3: "milliwatt"}, numeric},
+	{0x0005, "temperature", map[int]string{1: "celsius", 2: "fahrenheit", 3: "kelvin"}, numeric},
+	{0x0006, "relativeHumidity", map[int]string{1: "percent"}, numeric},
+	{0x0007, "luminosity", map[int]string{1: "lumen", 2: "candela", 3: "lux"}, numeric},
+	{0x0008, "time", map[int]string{1: "second", 2: "millisecond", 3: "microsecond"}, numeric},
+	{0x0009, "mass", map[int]string{1: "kilogram", 2: "gram", 3: "pound", 4: "ounce"}, numeric},
+	{0x000A, "pressure", map[int]string{1: "pascal", 2: "psi", 3: "bar"}, numeric},
+	{0x000B, "distance", map[int]string{1: "meter", 2: "centimeter", 3: "mile", 4: "kilometer"}, numeric},
+	{0x000C, "angle", map[int]string{1: "radian", 2: "degree"}, numeric},
+	{0x000D, "volume", map[int]string{1: "liter", 2: "milliliter", 3: "fluidOunce", 4: "gallon"}, numeric},
+	{0x000E, "area", map[int]string{1: "squareMeter", 2: "hectare", 3: "acre"}, numeric},
+	{0x000F, "rain", map[int]string{1: "millimeterPerHour"}, numeric},
+	{0x0010, "density", map[int]string{1: "kilogramPerCubicMeter"}, numeric},
+	{0x0011, "latitude", map[int]string{1: "degree"}, numeric},
+	{0x0012, "longitude", map[int]string{1: "degree"}, numeric},
+	{0x0013, "speed", map[int]string{1: "meterPerSecond", 2: "centimeterPerSecond", 3: "kilometerPerHour", 4: "milePerHour"}, numeric},
+	{0x0014, "volumeFlow", map[int]string{1: "cubicMeterPerSecond", 2: "standardCubicFootPerMinute", 3: "cubicMeterPerHour", 4: "literPerMinute", 5: "literPerHour"}, numeric},
+	{0x0015, "energy", map[int]string{1: "joule", 2: "newtonMeter", 3: "wattHour", 4: "kilowattHour"}, numeric},
+	{0xFFF0, "presence", map[int]string{0: "none"}, []int{ValueTypeBool}},
+	{0xFFF1, "switch", map[int]string{0: "none"}, []int{ValueTypeBool}},
+	{0xFFF2, "command", map[int]string{0: "none"}, []int{ValueTypeRaw}},
+}
+
+// LookupSchemaType finds the catalog entry of the type ID
+func LookupSchemaType(typeID int) (SchemaType, bool) {
+	for _, schemaType := range SchemaTypes {
+		if schemaType.ID == typeID {
+			return schemaType, true
+		}
+	}
+	return SchemaType{}, false
+}
+
+// Validate checks the schema against the catalog
+func (s Schema) Validate() error {
+	schemaType, ok := LookupSchemaType(s.TypeID)
+	if !ok {
+		return &SchemaError{Field: "typeId", Value: fmt.Sprintf("0x%04X", s.TypeID), Reason: "unknown type"}
+	}
+	if _, ok := schemaType.Units[s.Unit]; !ok {
+		return &SchemaError{Field: "unit", Value: fmt.Sprint(s.Unit), Reason: "not a unit of " + schemaType.Name}
+	}
+	for _, valueType := range schemaType.ValueTypes {
+		if valueType == s.ValueType {
+			return nil
+		}
+	}
+	return &SchemaError{Field: "valueType", Value: fmt.Sprint(s.ValueType), Reason: "not a value type of " + schemaType.Name}
+}
+
+// NewSchema builds a schema from a spec naming its type, unit and value
+// type, such as "temperature/celsius/float"
+func NewSchema(name string, spec string) (Schema, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) != 3 {
+		return Schema{}, fmt.Errorf("schema %q must be type/unit/valueType", spec)
+	}
+
+	schema := Schema{Name: name}
+	schemaType, ok := findByName(parts[0])
+	if !ok {
+		return Schema{}, &SchemaError{Field: "typeId", Value: parts[0], Reason: "unknown type"}
+	}
+	schema.TypeID = schemaType.ID
+
+	unit, ok := keyOf(schemaType.Units, parts[1])
+	if !ok {
+		return Schema{}, &SchemaError{Field: "unit", Value: parts[1], Reason: "not a unit of " + schemaType.Name}
+	}
+	schema.Unit = unit
+
+	valueType, ok := keyOf(ValueTypeNames, parts[2])
+	if !ok {
+		return Schema{}, &SchemaError{Field: "valueType", Value: parts[2], Reason: "unknown value type"}
+	}
+	schema.ValueType = valueType
+
+	return schema, schema.Validate()
+}
+
+func findByName(name string) (SchemaType, bool) {
+	for _, schemaType := range SchemaTypes {
+		if strings.EqualFold(schemaType.Name, name) {
+			return schemaType, true
+		}
+	}
+	return SchemaType{}, false
+}
+
+func keyOf(names map[int]string, name string) (int, bool) {
+	for key, value := range names {
+		if strings.EqualFold(value, name) {
+			return key, true
+		}
+	}
+	return 0, false
+}
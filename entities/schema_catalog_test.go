@@ -0,0 +1,78 @@
+package entities
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema Schema
+		field  string
+	}{
+		{"float temperature", Schema{TypeID: 0x0005, Unit: 1, ValueType: ValueTypeFloat}, ""},
+		{"int volume flow", Schema{TypeID: 0x0014, Unit: 5, ValueType: ValueTypeInt}, ""},
+		{"switch", Schema{TypeID: 0xFFF1, Unit: 0, ValueType: ValueTypeBool}, ""},
+		{"unknown type", Schema{TypeID: 0x0100, Unit: 1, ValueType: ValueTypeFloat}, "typeId"},
+		{"unit of another type", Schema{TypeID: 0x0003, Unit: 2, ValueType: ValueTypeFloat}, "unit"},
+		{"bool temperature", Schema{TypeID: 0x0005, Unit: 1, ValueType: ValueTypeBool}, "valueType"},
+		{"float switch", Schema{TypeID: 0xFFF1, Unit: 0, ValueType: ValueTypeFloat}, "valueType"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schema.Validate()
+			if tt.field == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			var schemaErr *SchemaError
+			if !errors.As(err, &schemaErr) || schemaErr.Field != tt.field {
+				t.Errorf("Validate() = %v, want an error on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestNewSchema(t *testing.T) {
+	tests := []struct {
+		spec   string
+		schema Schema
+		field  string
+	}{
+		{"temperature/celsius/float", Schema{Name: "sensor", TypeID: 0x0005, Unit: 1, ValueType: ValueTypeFloat}, ""},
+		{"VolumeFlow/CubicMeterPerHour/INT", Schema{Name: "sensor", TypeID: 0x0014, Unit: 3, ValueType: ValueTypeInt}, ""},
+		{"switch/none/bool", Schema{Name: "sensor", TypeID: 0xFFF1, Unit: 0, ValueType: ValueTypeBool}, ""},
+		{"flux/celsius/float", Schema{}, "typeId"},
+		{"temperature/volt/float", Schema{}, "unit"},
+		{"temperature/celsius/double", Schema{}, "valueType"},
+		{"temperature/celsius/bool", Schema{}, "valueType"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			schema, err := NewSchema("sensor", tt.spec)
+			if tt.field == "" {
+				if err != nil || schema != tt.schema {
+					t.Errorf("NewSchema() = %+v, %v, want %+v", schema, err, tt.schema)
+				}
+				return
+			}
+			var schemaErr *SchemaError
+			if !errors.As(err, &schemaErr) || schemaErr.Field != tt.field {
+				t.Errorf("NewSchema() = %v, want an error on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestNewSchemaMalformedSpec(t *testing.T) {
+	for _, spec := range []string{"", "temperature", "temperature/celsius", "temperature/celsius/float/extra"} {
+		_, err := NewSchema("sensor", spec)
+		var schemaErr *SchemaError
+		if err == nil || errors.As(err, &schemaErr) {
+			t.Errorf("NewSchema(%q) = %v, want a format error", spec, err)
+		}
+	}
+}
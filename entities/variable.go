@@ -39,7 +39,7 @@ type Variable struct {
 	ValorFloat             float32       `json:"ValorFloat"`
 	ValorString            string        `json:"ValorString"`
 	ValorDateTime          string        `json:"ValorDateTime"`
-	ValorConv              float32       `json:"ValorConv"`
+	ValorConv              *float32      `json:"ValorConv"`
 	ValorConvFormat        string        `json:"ValorConvFormat"`
 	ValorConvStrFormat     string        `json:"ValorConvStrFormat"`
 	DataLeitura            string        `json:"dataLeitura"`
@@ -104,6 +104,6 @@ type ReceivedData struct {
 }
 
 type VariableLastData struct {
-	Value     int
+	Value     interface{}
 	Timestamp string
 }
@@ -0,0 +1,145 @@
+package knot
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// eventTick is how often the periodic events are checked
+const eventTick = time.Second
+
+// sensorEvent is what the event engine remembers about a sensor
+type sensorEvent struct {
+	last    entities.Data
+	sent    interface{}
+	hasSent bool
+	sentAt  time.Time
+}
+
+// eventEngine decides which readings are published following the sensor
+// event config, the same way the KNoT thing firmware does: a reading is
+// sent when its value changed, when it is beyond one of the thresholds or
+// when timeSec elapsed since the last one sent. Sensors without any event
+// set publish every reading.
+type eventEngine struct {
+	sensors map[string]map[int]*sensorEvent
+}
+
+func newEventEngine() *eventEngine {
+	return &eventEngine{sensors: make(map[string]map[int]*sensorEvent)}
+}
+
+// filter returns the readings that must be published
+func (e *eventEngine) filter(device entities.Device, data []entities.Data, now time.Time) []entities.Data {
+	var publish []entities.Data
+	for _, reading := range data {
+		sensor := e.sensor(device.ID, reading.SensorID)
+		sensor.last = reading
+
+		event, ok := sensorEventConfig(device, reading.SensorID)
+		if ok && !mustPublish(event, sensor, reading.Value, now) {
+			continue
+		}
+		sensor.sent = reading.Value
+		sensor.hasSent = true
+		sensor.sentAt = now
+		publish = append(publish, reading)
+	}
+	return publish
+}
+
+// due returns the last value of the sensors whose timeSec elapsed since
+// they were last sent, stamped with the current time
+func (e *eventEngine) due(device entities.Device, now time.Time) []entities.Data {
+	var publish []entities.Data
+	for _, config := range device.Config {
+		if config.Event.TimeSec <= 0 {
+			continue
+		}
+		sensor, ok := e.sensors[device.ID][config.SensorID]
+		if !ok || !sensor.hasSent {
+			continue
+		}
+		if now.Sub(sensor.sentAt) < time.Duration(config.Event.TimeSec)*time.Second {
+			continue
+		}
+		sensor.sentAt = now
+		sensor.sent = sensor.last.Value
+		publish = append(publish, entities.Data{
+			SensorID:  config.SensorID,
+			Value:     sensor.last.Value,
+			TimeStamp: now.UTC().Format(time.RFC3339),
+		})
+	}
+	return publish
+}
+
+// forget drops what the engine knows about the device
+func (e *eventEngine) forget(deviceID string) {
+	delete(e.sensors, deviceID)
+}
+
+func (e *eventEngine) sensor(deviceID string, sensorID int) *sensorEvent {
+	sensors, ok := e.sensors[deviceID]
+	if !ok {
+		sensors = make(map[int]*sensorEvent)
+		e.sensors[deviceID] = sensors
+	}
+	sensor, ok := sensors[sensorID]
+	if !ok {
+		sensor = &sensorEvent{}
+		sensors[sensorID] = sensor
+	}
+	return sensor
+}
+
+// sensorEventConfig finds the event of the sensor, reporting false when no
+// event is set
+func sensorEventConfig(device entities.Device, sensorID int) (entities.Event, bool) {
+	for _, config := range device.Config {
+		if config.SensorID != sensorID {
+			continue
+		}
+		event := config.Event
+		if !event.Change && event.TimeSec <= 0 && event.LowerThreshold == nil && event.UpperThreshold == nil {
+			return event, false
+		}
+		return event, true
+	}
+	return entities.Event{}, false
+}
+
+func mustPublish(event entities.Event, sensor *sensorEvent, value interface{}, now time.Time) bool {
+	if !sensor.hasSent {
+		return true
+	}
+	if event.Change && !sameValue(sensor.sent, value) {
+		return true
+	}
+	if event.TimeSec > 0 && now.Sub(sensor.sentAt) >= time.Duration(event.TimeSec)*time.Second {
+		return true
+	}
+
+	number, ok := entities.ToFloat(value)
+	if !ok {
+		return false
+	}
+	if lower, ok := entities.ToFloat(event.LowerThreshold); ok && number < lower {
+		return true
+	}
+	if upper, ok := entities.ToFloat(event.UpperThreshold); ok && number > upper {
+		return true
+	}
+	return false
+}
+
+func sameValue(a, b interface{}) bool {
+	x, okA := entities.ToFloat(a)
+	y, okB := entities.ToFloat(b)
+	if okA && okB {
+		return x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
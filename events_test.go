@@ -0,0 +1,123 @@
+package knot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// eventDevice builds a device with a single sensor following the event
+func eventDevice(event entities.Event) entities.Device {
+	return entities.Device{
+		ID:     "0000000000000001",
+		Config: []entities.Config{{SensorID: 1, Event: event}},
+	}
+}
+
+func TestEventEngineFilter(t *testing.T) {
+	type reading struct {
+		value   interface{}
+		after   time.Duration
+		publish bool
+	}
+	tests := []struct {
+		name     string
+		event    entities.Event
+		readings []reading
+	}{
+		{
+			name:  "no event publishes every reading",
+			event: entities.Event{},
+			readings: []reading{
+				{1, 0, true},
+				{1, time.Second, true},
+			},
+		},
+		{
+			name:  "change",
+			event: entities.Event{Change: true},
+			readings: []reading{
+				{1, 0, true},
+				{1.0, time.Second, false},
+				{2, time.Second, true},
+				{2, time.Second, false},
+			},
+		},
+		{
+			name:  "change of a text value",
+			event: entities.Event{Change: true},
+			readings: []reading{
+				{"on", 0, true},
+				{"on", time.Second, false},
+				{"off", time.Second, true},
+			},
+		},
+		{
+			name:  "time",
+			event: entities.Event{TimeSec: 10},
+			readings: []reading{
+				{1, 0, true},
+				{2, 5 * time.Second, false},
+				{3, 5 * time.Second, true},
+				{4, 9 * time.Second, false},
+			},
+		},
+		{
+			name:  "thresholds",
+			event: entities.Event{LowerThreshold: 10, UpperThreshold: 20.5},
+			readings: []reading{
+				{15, 0, true},
+				{12, time.Second, false},
+				{9, time.Second, true},
+				{20.5, time.Second, false},
+				{21, time.Second, true},
+				{"text", time.Second, false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newEventEngine()
+			device := eventDevice(tt.event)
+			now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+			for i, reading := range tt.readings {
+				now = now.Add(reading.after)
+				data := []entities.Data{{SensorID: 1, Value: reading.value}}
+				published := len(engine.filter(device, data, now)) == 1
+				if published != reading.publish {
+					t.Errorf("reading %d (%v): published = %v, want %v", i, reading.value, published, reading.publish)
+				}
+			}
+		})
+	}
+}
+
+func TestEventEngineDue(t *testing.T) {
+	engine := newEventEngine()
+	device := eventDevice(entities.Event{Change: true, TimeSec: 10})
+	now := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	if due := engine.due(device, now); len(due) != 0 {
+		t.Fatalf("due %v before any reading, want none", due)
+	}
+	engine.filter(device, []entities.Data{{SensorID: 1, Value: 1}}, now)
+	engine.filter(device, []entities.Data{{SensorID: 1, Value: 1}}, now.Add(5*time.Second))
+	if due := engine.due(device, now.Add(9*time.Second)); len(due) != 0 {
+		t.Fatalf("due %v before timeSec, want none", due)
+	}
+
+	now = now.Add(10 * time.Second)
+	due := engine.due(device, now)
+	if len(due) != 1 || due[0].SensorID != 1 || due[0].Value != 1 || due[0].TimeStamp != now.Format(time.RFC3339) {
+		t.Fatalf("due %v, want the last value stamped now", due)
+	}
+	if due := engine.due(device, now.Add(time.Second)); len(due) != 0 {
+		t.Errorf("due %v right after being sent, want none", due)
+	}
+
+	engine.forget(device.ID)
+	if due := engine.due(device, now.Add(time.Hour)); len(due) != 0 {
+		t.Errorf("due %v of a forgotten device, want none", due)
+	}
+}
@@ -1,3 +1,14 @@
 module github.com/luisfelipemisi/knot
 
 go 1.18
+
+require (
+	github.com/cenkalti/backoff v2.2.1+incompatible
+	github.com/pkg/errors v0.9.1
+	github.com/sirupsen/logrus v1.9.3
+	github.com/streadway/amqp v1.1.0
+	go.etcd.io/bbolt v1.3.7
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require golang.org/x/sys v0.4.0 // indirect
@@ -1,6 +1,9 @@
 package knot
 
 import (
+	"context"
+	"sync"
+
 	"github.com/luisfelipemisi/knot/internal/config"
 	"github.com/luisfelipemisi/knot/internal/integration/knot/entities"
 	"github.com/luisfelipemisi/knot/internal/integration/knot/network"
@@ -8,34 +11,156 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// ErrClosed is returned by the operations called after the integration stopped.
+var ErrClosed = errors.New("knot integration closed")
+
 // Integration implements an KNoT integration.
 type Integration struct {
-	protocol Protocol
-}
+	protocol    Protocol
+	registry    *Registry
+	deviceChan  chan entities.Device
+	commandChan chan deviceCommand
+	msgChan     chan network.InMsg
+	ctx         context.Context
+	cancel      context.CancelFunc
 
-var deviceChan = make(chan entities.Device)
-var msgChan = make(chan network.InMsg)
+	// closing refuses the devices handed over once Close is called, the
+	// ones already waiting give up when the context is cancelled
+	closing sync.RWMutex
+	closed  bool
+}
 
-// New creates a new KNoT integration.
-func NewKNoTIntegration(pipeDevices chan map[string]entities.Device, conf config.IntegrationKNoTConfig, log *logrus.Entry, devices map[string]entities.Device) (*Integration, error) {
+// New creates a new KNoT integration. The integration stops when ctx is
+// cancelled or Close is called. When devices is nil they are loaded from the
+// configured store.
+func NewKNoTIntegration(ctx context.Context, pipeDevices chan map[string]entities.Device, conf config.IntegrationKNoTConfig, knotConf entities.KnotConfig, log *logrus.Entry, devices map[string]entities.Device) (*Integration, error) {
 	var err error
-	KNoTInteration := Integration{}
+	KNoTInteration := Integration{
+		deviceChan:  make(chan entities.Device),
+		commandChan: make(chan deviceCommand),
+		msgChan:     make(chan network.InMsg),
+	}
+	store, err := NewDeviceStore(knotConf.Store)
+	if err != nil {
+		return nil, errors.Wrap(err, "new device store")
+	}
+	if devices == nil {
+		devices, err = store.Load()
+		if err != nil {
+			return nil, errors.Wrap(err, "load devices")
+		}
+	}
+	KNoTInteration.registry = newRegistry(devices)
+	KNoTInteration.ctx, KNoTInteration.cancel = context.WithCancel(ctx)
 
-	KNoTInteration.protocol, err = newProtocol(pipeDevices, conf, deviceChan, msgChan, log, devices)
+	KNoTInteration.protocol, err = newProtocol(KNoTInteration.ctx, pipeDevices, conf, knotConf, KNoTInteration.deviceChan, KNoTInteration.commandChan, KNoTInteration.msgChan, log, KNoTInteration.registry, store)
 	if err != nil {
+		KNoTInteration.cancel()
 		return nil, errors.Wrap(err, "new knot protocol")
 	}
 
 	return &KNoTInteration, nil
 }
 
-// HandleUplinkEvent sends an UplinkEvent.
-func (i *Integration) HandleDevice(device entities.Device) {
+// HandleDevice sends the readings and configuration of the device, waiting
+// until the integration accepts them. It returns ErrClosed once the
+// integration stopped, in which case the device was not handled.
+func (i *Integration) HandleDevice(device entities.Device) error {
+	i.closing.RLock()
+	defer i.closing.RUnlock()
+	if i.closed {
+		return ErrClosed
+	}
+
 	device.State = ""
-	deviceChan <- device
+	select {
+	case i.deviceChan <- device:
+		return nil
+	case <-i.ctx.Done():
+		return ErrClosed
+	}
+}
+
+// Devices returns the registry of the devices handled by the integration.
+func (i *Integration) Devices() *Registry {
+	return i.registry
+}
+
+// UnknownErrors returns how many times each error Knot Cloud returned
+// without a known recovery was received.
+func (i *Integration) UnknownErrors() map[string]int {
+	return i.protocol.unknownErrors()
+}
+
+// SetCommandHandler sets the handler of the data requests and updates Knot
+// Cloud sends to the publishing devices. Commands are dropped while no
+// handler is set.
+func (i *Integration) SetCommandHandler(handler CommandHandler) {
+	i.protocol.setCommandHandler(handler)
 }
 
-// Close closes the integration.
+// SetRenameHandler sets the function told about the devices given a new ID,
+// which happens when Knot Cloud refuses the one they have. It runs on the
+// control routine, so it must not block.
+func (i *Integration) SetRenameHandler(handler func(oldID, newID string)) {
+	i.protocol.setRenameHandler(handler)
+}
+
+// AddDevice registers a new device on Knot Cloud without restarting the
+// integration and returns its ID. The device keeps its ID, one is generated
+// when it has none.
+func (i *Integration) AddDevice(device entities.Device) (string, error) {
+	if device.ID == "" {
+		id, err := tokenIDGenerator()
+		if err != nil {
+			return "", err
+		}
+		device.ID = id
+	}
+	err := i.sendCommand(deviceCommand{kind: commandAdd, device: device})
+	if err != nil {
+		return "", err
+	}
+	return device.ID, nil
+}
+
+// RemoveDevice unregisters the device from Knot Cloud and forgets it.
+func (i *Integration) RemoveDevice(id string) error {
+	return i.sendCommand(deviceCommand{kind: commandRemove, device: entities.Device{ID: id}})
+}
+
+// UpdateDeviceConfig replaces the configuration of the device and sends it
+// to Knot Cloud.
+func (i *Integration) UpdateDeviceConfig(id string, config []entities.Config) error {
+	return i.sendCommand(deviceCommand{kind: commandUpdateConfig, device: entities.Device{ID: id, Config: config}})
+}
+
+// sendCommand runs the command on the control routine and waits its result.
+func (i *Integration) sendCommand(command deviceCommand) error {
+	command.result = make(chan error, 1)
+	select {
+	case i.commandChan <- command:
+	case <-i.ctx.Done():
+		return ErrClosed
+	}
+
+	select {
+	case err := <-command.result:
+		return err
+	case <-i.ctx.Done():
+		return ErrClosed
+	}
+}
+
+// Close stops the integration, handling the devices already queued and
+// persisting the device map before closing the connection.
 func (integration *Integration) Close() error {
+	// Cancelling first releases the devices waiting on a control routine
+	// that is not receiving, the ones it takes while draining are handled
+	integration.cancel()
+
+	integration.closing.Lock()
+	integration.closed = true
+	integration.closing.Unlock()
 	return integration.protocol.Close()
 }
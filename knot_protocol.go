@@ -1,18 +1,18 @@
 package knot
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/luisfelipemisi/knot/config"
 	"github.com/luisfelipemisi/knot/integration/knot/entities"
 	"github.com/luisfelipemisi/knot/integration/knot/network"
 	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
 )
 
 // Protocol interface provides methods to handle KNoT Protocol
@@ -21,12 +21,13 @@ type Protocol interface {
 	createDevice(device entities.Device) error
 	deleteDevice(id string) error
 	updateDevice(device entities.Device) error
-	checkData(device entities.Device) error
 	checkDeviceConfiguration(device entities.Device) error
 	deviceExists(device entities.Device) bool
 	generateID(device entities.Device) (string, error)
-	checkTimeout(device entities.Device, log *logrus.Entry) entities.Device
-	requestsKnot(deviceChan chan entities.Device, device entities.Device, oldState string, curState string, message string, log *logrus.Entry)
+	checkTimeout(timeout requestTimeout) error
+	unknownErrors() map[string]int
+	setCommandHandler(handler CommandHandler)
+	setRenameHandler(handler func(oldID, newID string))
 }
 type networkWrapper struct {
 	amqp       *network.AMQP
@@ -35,15 +36,52 @@ type networkWrapper struct {
 }
 
 type protocol struct {
-	userToken string
-	network   *networkWrapper
-	devices   map[string]entities.Device
+	userToken   string
+	network     *networkWrapper
+	registry    *Registry
+	persister   *persister
+	buffer      *readingBuffer
+	events      *eventEngine
+	cloudErrors *cloudErrorStats
+	machine     *stateMachine
+	requests    *pendingRequests
+	timers      *requestTimers
+	deviceChan  chan entities.Device
+	commands    chan deviceCommand
+	handlerMu   sync.Mutex
+	handler     CommandHandler
+	renamed     func(oldID, newID string)
+	bindings    map[string]bool
+
+	cloudCommands  chan cloudCommand
+	commandReplies chan commandReply
+
+	pipeDevices chan map[string]entities.Device
+	log         *logrus.Entry
+	ctx         context.Context
+	wg          sync.WaitGroup
 }
 
-func newProtocol(pipeDevices chan map[string]entities.Device, conf config.IntegrationKNoTConfig, deviceChan chan entities.Device, msgChan chan network.InMsg, log *logrus.Entry, devices map[string]entities.Device) (Protocol, error) {
+func newProtocol(ctx context.Context, pipeDevices chan map[string]entities.Device, conf config.IntegrationKNoTConfig, knotConf entities.KnotConfig, deviceChan chan entities.Device, commandChan chan deviceCommand, msgChan chan network.InMsg, log *logrus.Entry, registry *Registry, store DeviceStore) (Protocol, error) {
 	p := &protocol{}
 
 	p.userToken = conf.UserToken
+	p.registry = registry
+	p.persister = newPersister(store, p.persistedDevices, knotConf.PersistIntervalInSeconds, log)
+	registry.durableChanged = p.persister.mark
+	p.machine = newStateMachine()
+	p.events = newEventEngine()
+	p.cloudErrors = newCloudErrorStats()
+	p.requests = newPendingRequests()
+	p.ctx = ctx
+	p.timers = newRequestTimers(ctx, knotConf)
+	p.deviceChan = deviceChan
+	p.commands = commandChan
+	p.bindings = make(map[string]bool)
+	p.cloudCommands = make(chan cloudCommand)
+	p.commandReplies = make(chan commandReply)
+	p.pipeDevices = pipeDevices
+	p.log = log
 	p.network = new(networkWrapper)
 	p.network.amqp = network.NewAMQP(conf.URL)
 	err := p.network.amqp.Start()
@@ -54,80 +92,82 @@ func newProtocol(pipeDevices chan map[string]entities.Device, conf config.Integr
 		log.Println("Knot connected")
 	}
 	p.network.publisher = network.NewMsgPublisher(p.network.amqp)
-	p.network.subscriber = network.NewMsgSubscriber(p.network.amqp)
+	p.network.subscriber = network.NewMsgSubscriber(p.network.amqp, knotConf.QueueName)
 
 	if err = p.network.subscriber.SubscribeToKNoTMessages(msgChan); err != nil {
 		log.Errorln("Error to subscribe")
 		return p, err
 	}
-	p.devices = make(map[string]entities.Device)
-	p.devices = devices
+	p.buffer, err = newReadingBuffer(knotConf.Buffer)
+	if err != nil {
+		return p, err
+	}
 
-	go handlerKnotAMQP(msgChan, deviceChan, log)
-	go dataControl(pipeDevices, deviceChan, p, log)
+	p.wg.Add(3)
+	go func() {
+		defer p.wg.Done()
+		p.persister.run(ctx)
+	}()
+	go func() {
+		defer p.wg.Done()
+		handlerKnotAMQP(ctx, msgChan, deviceChan, p.cloudCommands, p.requests, log)
+	}()
+	go func() {
+		defer p.wg.Done()
+		dataControl(pipeDevices, deviceChan, p, log)
+	}()
 
 	return p, nil
 }
 
-// Check for data to be updated
-func (p *protocol) checkData(device entities.Device) error {
-	var ok bool
-	id_pass := 0
-	ok = false
-	// Check if the ids are correct, no repetition
-	for _, data := range device.Data {
-		if data.SensorID != id_pass {
-			id_pass = data.SensorID
-			ok = true
-		} else {
-			ok = false
-		}
-		if data.TimeStamp == nil {
-			ok = false
-		}
-		if data.Value == nil {
-			ok = false
-		}
-		if !ok {
-			return fmt.Errorf("Invalid Data")
-		}
+// Keep the readings matching the device configuration, reporting each one rejected
+func (p *protocol) validData(device entities.Device) []entities.Data {
+	valid, rejected := validateData(device)
+	for _, err := range rejected {
+		p.log.Errorln(err)
 	}
-	if ok {
-		return nil
-	}
-	return fmt.Errorf("Invalid Data")
+	return valid
 }
 
-// Check for device configuration
+// Check the device configuration against the KNoT schema catalog
 func (p *protocol) checkDeviceConfiguration(device entities.Device) error {
-	var ok bool
-	id_pass := 0
-	// Check if the ids are correct, no repetition
-	for _, data := range device.Config {
-		if data.SensorID != id_pass {
-			id_pass = data.SensorID
-			ok = true
-		} else {
-			ok = false
-		}
+	if len(device.Config) == 0 {
+		return &ConfigError{DeviceID: device.ID, Field: "config", Err: fmt.Errorf("no sensor configured")}
 	}
-	if ok {
-		return nil
+
+	seen := make(map[int]bool, len(device.Config))
+	for _, config := range device.Config {
+		if seen[config.SensorID] {
+			return &ConfigError{DeviceID: device.ID, SensorID: config.SensorID, Field: "sensorId", Err: fmt.Errorf("repeated sensor")}
+		}
+		seen[config.SensorID] = true
+
+		err := config.Schema.Validate()
+		if err != nil {
+			configErr := &ConfigError{DeviceID: device.ID, SensorID: config.SensorID, Err: err}
+			if schemaErr, ok := err.(*entities.SchemaError); ok {
+				configErr.Field = "schema." + schemaErr.Field
+			}
+			return configErr
+		}
 	}
-	return fmt.Errorf("Invalid Config")
+	return nil
 }
 
 // Update the knot device information on map
 func (p *protocol) updateDevice(device entities.Device) error {
-	if _, checkDevice := p.devices[device.ID]; !checkDevice {
+	receiver, checkDevice := p.registry.Get(device.ID)
+	if !checkDevice {
 
 		return fmt.Errorf("Device do not exist")
 	}
 
-	receiver := p.devices[device.ID]
-
-	if p.checkDeviceConfiguration(device) == nil {
-		receiver.Config = device.Config
+	if device.Config != nil {
+		if err := p.checkDeviceConfiguration(device); err != nil {
+			p.log.Errorf("ignoring config: %v", err)
+		} else {
+			receiver.Config = device.Config
+		}
 	}
 	if device.Name != "" {
 		receiver.Name = device.Name
@@ -140,33 +180,25 @@ func (p *protocol) updateDevice(device entities.Device) error {
 	}
 
 	receiver.Data = nil
-	oldState := receiver.State
-	receiver.State = entities.KnotNew
-	p.devices[device.ID] = receiver
-
-	data, err := yaml.Marshal(&p.devices)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = os.WriteFile("internal/config/device_config.yaml", data, 0600)
-	if err != nil {
-		log.Fatal(err)
-	}
-	receiver.State = oldState
 	if device.State != "" {
 		receiver.State = device.State
 	}
-	if p.checkData(device) == nil {
-		receiver.Data = device.Data
-	}
-	p.devices[device.ID] = receiver
+	receiver.Data = device.Data
+	p.registry.set(receiver)
 
 	return nil
 }
 
-// Close closes the protocol.
+// Replace the stored copy of the device
+func (p *protocol) setDevice(device entities.Device) {
+	p.registry.set(device)
+}
+
+// Close waits for the protocol routines to finish and closes the connection.
+// The context given to newProtocol must be cancelled before calling it.
 func (p *protocol) Close() error {
+	p.wg.Wait()
+	p.timers.stopAll()
 	p.network.amqp.Stop()
 	return nil
 }
@@ -180,7 +212,7 @@ func (p *protocol) createDevice(device entities.Device) error {
 
 		device.State = entities.KnotNew
 
-		p.devices[device.ID] = device
+		p.registry.set(device)
 
 		return nil
 	}
@@ -188,11 +220,23 @@ func (p *protocol) createDevice(device entities.Device) error {
 
 // Create a new device ID
 func (p *protocol) generateID(device entities.Device) (string, error) {
-	delete(p.devices, device.ID)
 	var err error
+	oldID := device.ID
 	device.ID, err = tokenIDGenerator()
+	if err != nil {
+		return "", err
+	}
+	p.registry.remove(oldID)
+	p.requests.drop(oldID)
+	p.timers.rename(oldID, device.ID)
+	p.events.forget(oldID)
+	p.unsubscribeCommands(oldID)
 	device.Token = ""
-	p.devices[device.ID] = device
+	p.registry.set(device)
+	verifyErrors(p.buffer.rename(oldID, device.ID), p.log)
+	if oldID != "" {
+		p.notifyRename(oldID, device.ID)
+	}
 
 	log.Print(" generated a new Device ID : ")
 	log.Println(device.ID)
@@ -200,14 +244,27 @@ func (p *protocol) generateID(device entities.Device) (string, error) {
 	return device.ID, err
 }
 
-// Check if the device exists
-func (p *protocol) deviceExists(device entities.Device) bool {
+// Set the handler told about the devices given a new ID
+func (p *protocol) setRenameHandler(handler func(oldID, newID string)) {
+	p.handlerMu.Lock()
+	defer p.handlerMu.Unlock()
+	p.renamed = handler
+}
 
-	if _, checkDevice := p.devices[device.ID]; checkDevice {
+func (p *protocol) notifyRename(oldID, newID string) {
+	p.handlerMu.Lock()
+	renamed := p.renamed
+	p.handlerMu.Unlock()
 
-		return true
+	if renamed != nil {
+		renamed(oldID, newID)
 	}
-	return false
+}
+
+// Check if the device exists
+func (p *protocol) deviceExists(device entities.Device) bool {
+
+	return p.registry.exists(device.ID)
 }
 
 // Generated a new Device ID
@@ -229,17 +286,27 @@ func errorFormat(device entities.Device, strError string) entities.Device {
 
 // Delete the knot device from map
 func (p *protocol) deleteDevice(id string) error {
-	if _, d := p.devices[id]; !d {
+	if !p.registry.remove(id) {
 		return fmt.Errorf("Device do not exist")
 	}
-
-	delete(p.devices, id)
 	return nil
 }
 
 //non-blocking channel to update devices on the other routin
-func updateDeviceMap(pipeDevices chan map[string]entities.Device, devices map[string]entities.Device) {
-	pipeDevices <- devices
+func updateDeviceMap(ctx context.Context, pipeDevices chan map[string]entities.Device, devices map[string]entities.Device) {
+	select {
+	case pipeDevices <- devices:
+	case <-ctx.Done():
+	}
+}
+
+// Share the device map with the other routine without blocking the control routine
+func (p *protocol) shareDevices() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		updateDeviceMap(p.ctx, p.pipeDevices, p.registry.Snapshot())
+	}()
 }
 
 func verifyErrors(err error, log *logrus.Entry) {
@@ -248,202 +315,153 @@ func verifyErrors(err error, log *logrus.Entry) {
 	}
 }
 
-//init the timeout couter
-func initTimeout(deviceChan chan entities.Device, device entities.Device) {
-	go func(deviceChan chan entities.Device, device entities.Device) {
-		time.Sleep(20 * time.Second)
-		device.Error = "timeOut"
-		deviceChan <- device
-	}(deviceChan, device)
+// Control device paths
+func dataControl(pipeDevices chan map[string]entities.Device, deviceChan chan entities.Device, p *protocol, log *logrus.Entry) {
+	updateDeviceMap(p.ctx, pipeDevices, p.registry.Snapshot())
+
+	eventTicker := time.NewTicker(eventTick)
+	defer eventTicker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			p.drain(deviceChan)
+			return
+		case device, ok := <-deviceChan:
+			if !ok {
+				return
+			}
+			p.handleDevice(device)
+		case command := <-p.commands:
+			command.result <- p.runCommand(command)
+		case command := <-p.cloudCommands:
+			p.handleCloudCommand(command)
+		case reply := <-p.commandReplies:
+			p.publishReply(reply)
+		case timeout := <-p.timers.timeouts:
+			verifyErrors(p.checkTimeout(timeout), log)
+		case now := <-eventTicker.C:
+			p.publishPeriodic(now)
+		}
+	}
 }
 
-// check response time
-func (p *protocol) requestsKnot(deviceChan chan entities.Device, device entities.Device, oldState string, curState string, message string, log *logrus.Entry) {
-	device.State = oldState
-	initTimeout(deviceChan, device)
-	device.State = curState
-	err := p.updateDevice(device)
-	if err != nil {
-		log.Errorln(err)
-	} else {
-		log.Println(message)
-		switch oldState {
-		case entities.KnotNew:
-			err = p.network.publisher.PublishDeviceRegister(p.userToken, &device)
-		case entities.KnotRegistered:
-			err = p.network.publisher.PublishDeviceAuth(p.userToken, &device)
-		case entities.KnotAuth:
-			err = p.network.publisher.PublishDeviceUpdateConfig(p.userToken, &device)
+// Handle the devices still queued and persist the device map before stopping
+func (p *protocol) drain(deviceChan chan entities.Device) {
+	for {
+		select {
+		case device := <-deviceChan:
+			p.handleDevice(device)
+		default:
+			p.persister.flushAll()
+			return
 		}
-		verifyErrors(err, log)
 	}
 }
 
-// Control device paths
-func dataControl(pipeDevices chan map[string]entities.Device, deviceChan chan entities.Device, p *protocol, log *logrus.Entry) {
-	pipeDevices <- p.devices
+// Move the device along its lifecycle
+func (p *protocol) handleDevice(device entities.Device) {
+	if !p.deviceExists(device) {
+		p.log.Error("device id received does not match the stored")
+		return
+	}
 
-	for device := range deviceChan {
+	// Responses from Knot Cloud carry the state they move the device to,
+	// readings and configurations from the device side carry none
+	next := device.State
+	device.State = ""
+	err := p.updateDevice(device)
+	if err != nil {
+		p.log.Errorln(err)
+		return
+	}
+	device, _ = p.registry.Get(device.ID)
 
-		if !p.deviceExists(device) {
-			if device.Error != "timeOut" {
-				log.Error("device id received does not match the stored")
-			}
-		} else {
+	// Keep the readings that cannot be published now
+	if next == "" && device.State != entities.KnotPublishing && device.Data != nil {
+		device = p.bufferData(device)
+	}
 
-			device = p.checkTimeout(device, log)
-			if device.State != entities.KnotOff && device.Error != "timeOut" {
-
-				err := p.updateDevice(device)
-				verifyErrors(err, log)
-				device = p.devices[device.ID]
-
-				if device.Name == "" {
-					log.Fatalln("Device has no name")
-				} else if device.State == entities.KnotNew {
-					if device.Token != "" {
-						device.State = entities.KnotRegistered
-					} else {
-						id, err := p.generateID(device)
-						if err != nil {
-							device.State = entities.KnotOff
-							log.Error(err)
-						} else {
-							device.State = entities.KnotNew
-							device.ID = id
-							err = p.updateDevice(device)
-							if err != nil {
-								log.Error(err)
-							}
-							go updateDeviceMap(pipeDevices, p.devices)
-						}
-					}
-				}
-			} else if device.Error == "timeOut" {
-				device.Error = ""
-			}
-			switch device.State {
-
-			// If the device status is new, request a device registration
-			case entities.KnotNew:
-
-				p.requestsKnot(deviceChan, device, device.State, entities.KnotWaitReg, "send a register request", log)
-
-			// If the device is already registered, ask for device authentication
-			case entities.KnotRegistered:
-
-				p.requestsKnot(deviceChan, device, device.State, entities.KnotWaitAuth, "send a auth request", log)
-
-			// The device has a token and authentication was successful.
-			case entities.KnotAuth:
-
-				p.requestsKnot(deviceChan, device, device.State, entities.KnotWaitConfig, "send a updateconfig request", log)
-
-			//everything is ok with knot device
-			case entities.KnotReady:
-				device.State = entities.KnotPublishing
-				err := p.updateDevice(device)
-				if err != nil {
-					log.Errorln(err)
-				} else {
-					go updateDeviceMap(pipeDevices, p.devices)
-				}
-			// Send the new data that comes from the device to Knot Cloud
-			case entities.KnotPublishing:
-				if p.checkData(device) == nil {
-					log.Println("send data of device ", device.Data[0].SensorID)
-
-					err := p.network.publisher.PublishDeviceData(p.userToken, &device, device.Data)
-					if err != nil {
-						log.Errorln(err)
-					} else {
-						device.Data = nil
-						err = p.updateDevice(device)
-						verifyErrors(err, log)
-					}
-				} else {
-					log.Println("invalid data, has no data to send")
-				}
-
-			// If the device is already registered, ask for device authentication
-			case entities.KnotAlreadyReg:
-
-				var err error
-				if device.Token == "" {
-					device.ID, err = p.generateID(device)
-					if err != nil {
-						log.Error(err)
-					} else {
-						go updateDeviceMap(pipeDevices, p.devices)
-						p.requestsKnot(deviceChan, device, entities.KnotNew, entities.KnotWaitReg, "send a register request", log)
-					}
-				} else {
-
-					p.requestsKnot(deviceChan, device, entities.KnotRegistered, entities.KnotWaitAuth, "send a Auth request", log)
-
-				}
-
-			// Just delete
-			case entities.KnotForceDelete:
-				var err error
-				log.Println("delete a device")
-
-				device.ID, err = p.generateID(device)
-				if err != nil {
-					log.Error(err)
-				} else {
-					go updateDeviceMap(pipeDevices, p.devices)
-					p.requestsKnot(deviceChan, device, entities.KnotNew, entities.KnotWaitReg, "send a register request", log)
-				}
-
-			// Handle errors
-			case entities.KnotError:
-				log.Println("ERROR: ")
-				switch device.Error {
-				// If the device is new to the chirpstack platform, but already has a registration in Knot, first the device needs to ask to unregister and then ask for a registration.
-				case "thing's config not provided":
-					log.Println("thing's config not provided")
-
-				default:
-					log.Println("ERROR WITHOUT HANDLER" + device.Error)
-
-				}
-				device.State = entities.KnotNew
-				device.Error = ""
-				err := p.updateDevice(device)
-				verifyErrors(err, log)
-
-			// ignore the device
-			case entities.KnotOff:
+	if next == "" {
+		_, err = p.machine.update(p, device)
+	} else {
+		_, err = p.machine.fire(p, device, next)
+	}
+	verifyErrors(err, p.log)
+}
 
-			}
+// Send the readings after the ones buffered while the device could not publish
+func (p *protocol) sendData(device entities.Device, data []entities.Data) {
+	if data == nil && !p.buffer.pending(device.ID) {
+		return
+	}
+
+	err := p.buffer.replay(device.ID, data, func(batch []entities.Data) error {
+		p.log.Println("send data of device ", batch[0].SensorID)
+		return p.network.publisher.PublishDeviceData(p.userToken, &device, batch)
+	})
+	verifyErrors(err, p.log)
+}
 
+// Send again the last value of the sensors whose event time elapsed
+func (p *protocol) publishPeriodic(now time.Time) {
+	for _, device := range p.registry.ListByState(entities.KnotPublishing) {
+		if data := p.events.due(device, now); data != nil {
+			p.sendData(device, data)
 		}
 	}
 }
 
-//check if response was received by comparing previous state with the new one
-func (p *protocol) checkTimeout(device entities.Device, log *logrus.Entry) entities.Device {
-
-	if device.Error == "timeOut" {
-		curDevice := p.devices[device.ID]
-		if device.State == entities.KnotNew && curDevice.State == entities.KnotWaitReg {
-			log.Println("error: TimeOut")
-			return device
-		} else if device.State == entities.KnotRegistered && curDevice.State == entities.KnotWaitAuth {
-			log.Println("error: TimeOut")
-			return device
-		} else if device.State == entities.KnotAuth && curDevice.State == entities.KnotWaitConfig {
-			log.Println("error: TimeOut")
-			return device
-		} else {
-			device.State = entities.KnotOff
-			return device
-		}
+// Move the device readings to the disk buffer
+func (p *protocol) bufferData(device entities.Device) entities.Device {
+	data := p.events.filter(device, p.validData(device), time.Now())
+	if err := p.buffer.add(device.ID, data); err != nil {
+		p.log.Errorln(err)
+		return device
 	}
+	device.Data = nil
+	p.setDevice(device)
 	return device
 }
 
+// Send the request again when it got no response or apply the recovery of
+// the error Knot Cloud answered, quarantining the device when the step has
+// no attempts left
+func (p *protocol) checkTimeout(timeout requestTimeout) error {
+	current, exhausted := p.timers.expired(timeout)
+	if !current {
+		return nil
+	}
+	device, ok := p.registry.Get(timeout.deviceID)
+	if !ok || device.State != timeout.state {
+		return nil
+	}
+
+	if device.Error == "" {
+		p.log.Println("error: TimeOut")
+	}
+	if exhausted {
+		_, err := p.machine.fire(p, device, entities.KnotQuarantine)
+		return err
+	}
+
+	next := recoveryState(device)
+	device.Error = ""
+	p.setDevice(device)
+	var err error
+	if next == "" {
+		_, err = p.machine.retry(p, device)
+	} else {
+		_, err = p.machine.fire(p, device, next)
+	}
+	return err
+}
+
+// Return how many times each unknown Knot Cloud error was received
+func (p *protocol) unknownErrors() map[string]int {
+	return p.cloudErrors.snapshot()
+}
+
 // Handle amqp messages
 func handlerAMQPmessage(message network.InMsg, log *logrus.Entry) entities.Device {
 	receiver := network.DeviceGenericMessage{}
@@ -459,10 +477,63 @@ func handlerAMQPmessage(message network.InMsg, log *logrus.Entry) entities.Devic
 	return device
 }
 
+// Check if the message answers a pending request, late and duplicated replies are dropped
+func matchReply(message network.InMsg, requests *pendingRequests, log *logrus.Entry) bool {
+	kind, ok := replyKinds[message.RoutingKey]
+	if !ok {
+		return false
+	}
+
+	receiver := network.DeviceGenericMessage{}
+	err := json.Unmarshal(message.Body, &receiver)
+	if err != nil {
+		log.Errorln(err)
+		return false
+	}
+
+	if requests.match(message.CorrelationID, receiver.ID, kind) {
+		// The device was already removed when the request was sent
+		if kind == kindUnregister {
+			log.Println("received a unregistration response of a removed device")
+			return false
+		}
+		return true
+	}
+	// Knot Cloud can unregister a device without being asked to
+	if kind == kindUnregister {
+		return true
+	}
+	log.Printf("dropped a %s reply of device %s with no pending request", kind, receiver.ID)
+	return false
+}
+
+// Send the device to the control routine unless the protocol is closing
+func sendDevice(ctx context.Context, deviceChan chan entities.Device, device entities.Device) {
+	select {
+	case deviceChan <- device:
+	case <-ctx.Done():
+	}
+}
+
 // Handles messages coming from AMQP
-func handlerKnotAMQP(msgChan <-chan network.InMsg, deviceChan chan entities.Device, log *logrus.Entry) {
+func handlerKnotAMQP(ctx context.Context, msgChan <-chan network.InMsg, deviceChan chan entities.Device, cloudCommands chan cloudCommand, requests *pendingRequests, log *logrus.Entry) {
+
+	for {
+		var message network.InMsg
+		select {
+		case <-ctx.Done():
+			return
+		case message = <-msgChan:
+		}
 
-	for message := range msgChan {
+		if command, ok := parseCloudCommand(message, log); ok {
+			sendCloudCommand(ctx, cloudCommands, command)
+			continue
+		}
+
+		if !matchReply(message, requests, log) {
+			continue
+		}
 
 		switch message.RoutingKey {
 
@@ -472,18 +543,12 @@ func handlerKnotAMQP(msgChan <-chan network.InMsg, deviceChan chan entities.Devi
 			device := handlerAMQPmessage(message, log)
 
 			if device.Error != "" {
-				// Alread registered
 				log.Println("received a registration response with a error")
-				if device.Error == "thing is already registered" {
-					device.State = entities.KnotAlreadyReg
-					deviceChan <- device
-				} else {
-					deviceChan <- errorFormat(device, device.Error)
-				}
+				sendDevice(ctx, deviceChan, replyError(device, kindRegister))
 			} else {
 				log.Println("received a registration response with no error")
 				device.State = entities.KnotRegistered
-				deviceChan <- device
+				sendDevice(ctx, deviceChan, device)
 			}
 
 		// Unregistered
@@ -492,40 +557,32 @@ func handlerKnotAMQP(msgChan <-chan network.InMsg, deviceChan chan entities.Devi
 			device := handlerAMQPmessage(message, log)
 			device.State = entities.KnotForceDelete
 
-			deviceChan <- device
+			sendDevice(ctx, deviceChan, device)
 
 		// Receive a auth msg
 		case network.ReplyToAuthMessages:
 			device := handlerAMQPmessage(message, log)
 
 			if device.Error != "" {
-				// Alread registered
 				log.Println("received a authentication response with a error")
-				device.State = entities.KnotForceDelete
-				deviceChan <- device
+				sendDevice(ctx, deviceChan, replyError(device, kindAuth))
 			} else {
 				log.Println("received a authentication response with no error")
 				device.State = entities.KnotAuth
-				deviceChan <- device
+				sendDevice(ctx, deviceChan, device)
 
 			}
 		case network.BindingKeyUpdatedConfig:
 
 			device := handlerAMQPmessage(message, log)
 
-			if device.Error == "failed to validate if config is valid: error getting thing metadata: thing not found on thing's service" {
-
-				log.Println("sent the configuration again")
-				device.State = entities.KnotAuth
-				deviceChan <- device
-
-			} else if device.Error != "" {
+			if device.Error != "" {
 				log.Println("received a config update response with a error")
-				deviceChan <- errorFormat(device, device.Error)
+				sendDevice(ctx, deviceChan, replyError(device, kindConfig))
 			} else {
 				log.Println("received a config update response with no error")
 				device.State = entities.KnotReady
-				deviceChan <- device
+				sendDevice(ctx, deviceChan, device)
 			}
 		}
 	}
@@ -0,0 +1,54 @@
+package knot
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// closedProtocol stands in for the protocol of an integration whose
+// control routine is not receiving
+type closedProtocol struct {
+	Protocol
+}
+
+func (closedProtocol) Close() error { return nil }
+
+func TestCloseReleasesBlockedHandleDevice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	integration := &Integration{
+		protocol:   closedProtocol{},
+		deviceChan: make(chan entities.Device),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	handled := make(chan error, 1)
+	go func() {
+		handled <- integration.HandleDevice(entities.Device{ID: "0000000000000001"})
+	}()
+	// Let HandleDevice block on the device channel
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- integration.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return while HandleDevice was blocked")
+	}
+	if err := <-handled; !errors.Is(err, ErrClosed) {
+		t.Errorf("blocked HandleDevice() = %v, want ErrClosed", err)
+	}
+	if err := integration.HandleDevice(entities.Device{ID: "0000000000000001"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("HandleDevice() after Close = %v, want ErrClosed", err)
+	}
+}
@@ -3,6 +3,7 @@ package network
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"github.com/cenkalti/backoff"
 	"github.com/streadway/amqp"
@@ -23,6 +24,11 @@ type AMQP struct {
 	conn    *amqp.Connection
 	channel *amqp.Channel
 	queue   *amqp.Queue
+
+	// done stops the routines handing over the deliveries
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
 // InMsg represents the message received from the AMQP broker
@@ -45,7 +51,7 @@ type MessageOptions struct {
 
 // NewAMQP constructs the AMQP connection handler
 func NewAMQP(url string) *AMQP {
-	return &AMQP{url, nil, nil, nil}
+	return &AMQP{url: url, done: make(chan struct{})}
 }
 
 // Start starts the message handling
@@ -59,16 +65,18 @@ func (a *AMQP) Start() error {
 	return nil
 }
 
-// Stop closes the connection started
+// Stop closes the connection started and waits for the routines handing
+// over the deliveries to return
 func (a *AMQP) Stop() {
-	if a.conn != nil && !a.conn.IsClosed() {
-		defer a.conn.Close()
-	}
+	a.stopOnce.Do(func() { close(a.done) })
 
 	if a.channel != nil {
-		defer a.channel.Close()
+		a.channel.Close()
 	}
-
+	if a.conn != nil && !a.conn.IsClosed() {
+		a.conn.Close()
+	}
+	a.wg.Wait()
 }
 
 // OnMessage receive messages and put them on channel
@@ -78,7 +86,7 @@ func (a *AMQP) OnMessage(msgChan chan InMsg, queueName, exchangeName, exchangeTy
 		return err
 	}
 
-	err = a.declareQueue(queueName)
+	queueName, err = a.DeclareQueue(queueName)
 	if err != nil {
 		return err
 	}
@@ -107,11 +115,41 @@ func (a *AMQP) OnMessage(msgChan chan InMsg, queueName, exchangeName, exchangeTy
 		return err
 	}
 
-	go convertDeliveryToInMsg(deliveries, msgChan)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		convertDeliveryToInMsg(deliveries, msgChan, a.done)
+	}()
 
 	return nil
 }
 
+// Bind routes the messages with the key to a queue that is already consumed
+func (a *AMQP) Bind(queueName, exchangeName, exchangeType, key string) error {
+	err := a.declareExchange(exchangeName, exchangeType)
+	if err != nil {
+		return err
+	}
+
+	return a.channel.QueueBind(
+		queueName,
+		key,
+		exchangeName,
+		false, // noWait
+		nil,   // arguments
+	)
+}
+
+// Unbind stops routing the messages with the key to the queue
+func (a *AMQP) Unbind(queueName, exchangeName, key string) error {
+	return a.channel.QueueUnbind(
+		queueName,
+		key,
+		exchangeName,
+		nil, // arguments
+	)
+}
+
 // PublishPersistentMessage sends a persistent message to RabbitMQ
 func (a *AMQP) PublishPersistentMessage(exchange, exchangeType, key string, data interface{}, options *MessageOptions) error {
 	var headers map[string]interface{}
@@ -185,6 +223,8 @@ func (a *AMQP) connect() error {
 	}
 
 	a.channel = channel
+	// The exclusive queue went away with the previous connection
+	a.queue = nil
 
 	return nil
 }
@@ -201,22 +241,40 @@ func (a *AMQP) declareExchange(name, exchangeType string) error {
 	)
 }
 
-func (a *AMQP) declareQueue(name string) error {
+// DeclareQueue declares the durable queue with the given name. When the name
+// is empty the server names the queue, which is exclusive to the connection
+// and deleted with it. The queue already declared is kept, and its name is
+// returned.
+func (a *AMQP) DeclareQueue(name string) (string, error) {
+	if a.queue != nil && (name == "" || name == a.queue.Name) {
+		return a.queue.Name, nil
+	}
+
+	exclusive := name == ""
 	queue, err := a.channel.QueueDeclare(
 		name,
-		true,  // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // noWait
-		nil,   // arguments
+		!exclusive, // durable
+		exclusive,  // delete when unused
+		exclusive,  // exclusive
+		false,      // noWait
+		nil,        // arguments
 	)
+	if err != nil {
+		return "", err
+	}
 
 	a.queue = &queue
-	return err
+	return queue.Name, nil
 }
 
-func convertDeliveryToInMsg(deliveries <-chan amqp.Delivery, outMsg chan InMsg) {
+// convertDeliveryToInMsg hands over the deliveries until the channel is
+// closed, or until done is closed when nobody receives them anymore
+func convertDeliveryToInMsg(deliveries <-chan amqp.Delivery, outMsg chan InMsg, done <-chan struct{}) {
 	for d := range deliveries {
-		outMsg <- InMsg{d.Exchange, d.RoutingKey, d.ReplyTo, d.CorrelationId, d.Headers, d.Body}
+		select {
+		case outMsg <- InMsg{d.Exchange, d.RoutingKey, d.ReplyTo, d.CorrelationId, d.Headers, d.Body}:
+		case <-done:
+			return
+		}
 	}
 }
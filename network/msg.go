@@ -70,3 +70,15 @@ type DataSent struct {
 	ID   string          `json:"id"`
 	Data []entities.Data `json:"data"`
 }
+
+// DataRequest represents the incoming command asking for the sensors readings
+type DataRequest struct {
+	ID        string `json:"id"`
+	SensorIds []int  `json:"sensorIds"`
+}
+
+// DataUpdate represents the incoming command writing values to the sensors
+type DataUpdate struct {
+	ID   string          `json:"id"`
+	Data []entities.Data `json:"data"`
+}
@@ -10,17 +10,15 @@ const (
 	routingKeyAuth         = "device.auth"
 	routingKeyUpdateConfig = "device.config.sent"
 
-	defaultCorrelationID = "default-corrId"
-
 	defaultExpirationTime = "2000"
 )
 
 // Publisher provides methods to subscribe to events on message broker
 type Publisher interface {
-	PublishDeviceRegister(userToken string, device *entities.Device) error
-	PublishDeviceUnregister(userToken string, device *entities.Device) error
-	PublishDeviceAuth(userToken string, device *entities.Device) error
-	PublishDeviceUpdateConfig(userToken string, device *entities.Device) error
+	PublishDeviceRegister(userToken string, device *entities.Device, correlationID string) error
+	PublishDeviceUnregister(userToken string, device *entities.Device, correlationID string) error
+	PublishDeviceAuth(userToken string, device *entities.Device, correlationID string) error
+	PublishDeviceUpdateConfig(userToken string, device *entities.Device, correlationID string) error
 	PublishDeviceData(userToken string, device *entities.Device, data []entities.Data) error
 }
 
@@ -33,10 +31,11 @@ func NewMsgPublisher(amqp *AMQP) Publisher {
 	return &msgPublisher{amqp}
 }
 
-func (mp *msgPublisher) PublishDeviceRegister(userToken string, device *entities.Device) error {
+func (mp *msgPublisher) PublishDeviceRegister(userToken string, device *entities.Device, correlationID string) error {
 	options := MessageOptions{
 		Authorization: userToken,
 		Expiration:    defaultExpirationTime,
+		CorrelationID: correlationID,
 	}
 
 	message := DeviceRegisterRequest{
@@ -52,10 +51,11 @@ func (mp *msgPublisher) PublishDeviceRegister(userToken string, device *entities
 	return nil
 }
 
-func (mp *msgPublisher) PublishDeviceUnregister(userToken string, device *entities.Device) error {
+func (mp *msgPublisher) PublishDeviceUnregister(userToken string, device *entities.Device, correlationID string) error {
 	options := MessageOptions{
 		Authorization: userToken,
 		Expiration:    defaultExpirationTime,
+		CorrelationID: correlationID,
 	}
 
 	message := DeviceUnregisterRequest{
@@ -70,11 +70,11 @@ func (mp *msgPublisher) PublishDeviceUnregister(userToken string, device *entiti
 	return nil
 }
 
-func (mp *msgPublisher) PublishDeviceAuth(userToken string, device *entities.Device) error {
+func (mp *msgPublisher) PublishDeviceAuth(userToken string, device *entities.Device, correlationID string) error {
 	options := MessageOptions{
 		Authorization: userToken,
 		Expiration:    defaultExpirationTime,
-		CorrelationID: defaultCorrelationID,
+		CorrelationID: correlationID,
 		ReplyTo:       ReplyToAuthMessages,
 	}
 
@@ -91,10 +91,11 @@ func (mp *msgPublisher) PublishDeviceAuth(userToken string, device *entities.Dev
 	return nil
 }
 
-func (mp *msgPublisher) PublishDeviceUpdateConfig(userToken string, device *entities.Device) error {
+func (mp *msgPublisher) PublishDeviceUpdateConfig(userToken string, device *entities.Device, correlationID string) error {
 	options := MessageOptions{
 		Authorization: userToken,
 		Expiration:    defaultExpirationTime,
+		CorrelationID: correlationID,
 	}
 
 	message := ConfigUpdateRequest{
@@ -1,29 +1,55 @@
 package network
 
-const (
-	queueName = "copergas-knot-messages"
+import (
+	"fmt"
+	"strings"
+)
 
+const (
 	BindingKeyRegistered    = "device.registered"
 	BindingKeyUnregistered  = "device.unregistered"
 	BindingKeyUpdatedConfig = "device.config.updated"
+
+	bindingKeyDataRequest = "device.%s.data.request"
+	bindingKeyDataUpdate  = "device.%s.data.update"
+)
+
+// Kinds of the commands Knot Cloud sends to a device
+const (
+	CommandDataRequest = "data.request"
+	CommandDataUpdate  = "data.update"
 )
 
 // Subscriber provides methods to subscribe to events on message broker
 type Subscriber interface {
 	SubscribeToKNoTMessages(msgChan chan InMsg) error
+	// SubscribeToDeviceCommands receives the commands sent to the device on
+	// the queue already subscribed
+	SubscribeToDeviceCommands(deviceID string) error
+	UnsubscribeFromDeviceCommands(deviceID string) error
 }
 
 type msgSubscriber struct {
 	amqp *AMQP
+	// name is the configured queue name, queueName the one declared
+	name      string
+	queueName string
 }
 
-// NewMsgSubscriber constructs the msgSubscriber
-func NewMsgSubscriber(amqp *AMQP) Subscriber {
-	return &msgSubscriber{amqp}
+// NewMsgSubscriber constructs the msgSubscriber, each subscriber must have
+// its own queue so it receives every message. When queueName is empty the
+// server names a queue exclusive to the subscriber.
+func NewMsgSubscriber(amqp *AMQP, queueName string) Subscriber {
+	return &msgSubscriber{amqp: amqp, name: queueName, queueName: queueName}
 }
 
 func (ms *msgSubscriber) SubscribeToKNoTMessages(msgChan chan InMsg) error {
-	var err error
+	queueName, err := ms.amqp.DeclareQueue(ms.name)
+	if err != nil {
+		return err
+	}
+	ms.queueName = queueName
+
 	subscribe := func(msgChan chan InMsg, queue, exchange, kind, key string) {
 		if err != nil {
 			return
@@ -31,10 +57,39 @@ func (ms *msgSubscriber) SubscribeToKNoTMessages(msgChan chan InMsg) error {
 		err = ms.amqp.OnMessage(msgChan, queue, exchange, kind, key)
 	}
 
-	subscribe(msgChan, queueName, exchangeDevice, exchangeTypeDirect, BindingKeyRegistered)
-	subscribe(msgChan, queueName, exchangeDevice, exchangeTypeDirect, BindingKeyUnregistered)
-	subscribe(msgChan, queueName, exchangeDevice, exchangeTypeDirect, ReplyToAuthMessages)
-	subscribe(msgChan, queueName, exchangeDevice, exchangeTypeDirect, BindingKeyUpdatedConfig)
+	subscribe(msgChan, ms.queueName, exchangeDevice, exchangeTypeDirect, BindingKeyRegistered)
+	subscribe(msgChan, ms.queueName, exchangeDevice, exchangeTypeDirect, BindingKeyUnregistered)
+	subscribe(msgChan, ms.queueName, exchangeDevice, exchangeTypeDirect, ReplyToAuthMessages)
+	subscribe(msgChan, ms.queueName, exchangeDevice, exchangeTypeDirect, BindingKeyUpdatedConfig)
 
-	return nil
+	return err
+}
+
+func (ms *msgSubscriber) SubscribeToDeviceCommands(deviceID string) error {
+	err := ms.amqp.Bind(ms.queueName, exchangeDevice, exchangeTypeDirect, fmt.Sprintf(bindingKeyDataRequest, deviceID))
+	if err != nil {
+		return err
+	}
+	return ms.amqp.Bind(ms.queueName, exchangeDevice, exchangeTypeDirect, fmt.Sprintf(bindingKeyDataUpdate, deviceID))
+}
+
+func (ms *msgSubscriber) UnsubscribeFromDeviceCommands(deviceID string) error {
+	err := ms.amqp.Unbind(ms.queueName, exchangeDevice, fmt.Sprintf(bindingKeyDataRequest, deviceID))
+	if err != nil {
+		return err
+	}
+	return ms.amqp.Unbind(ms.queueName, exchangeDevice, fmt.Sprintf(bindingKeyDataUpdate, deviceID))
+}
+
+// ParseCommandKey returns the device and the command of a routing key such
+// as device.<id>.data.request
+func ParseCommandKey(key string) (deviceID string, command string, ok bool) {
+	for _, command := range []string{CommandDataRequest, CommandDataUpdate} {
+		suffix := "." + command
+		if strings.HasPrefix(key, "device.") && strings.HasSuffix(key, suffix) {
+			deviceID = strings.TrimSuffix(strings.TrimPrefix(key, "device."), suffix)
+			return deviceID, command, deviceID != ""
+		}
+	}
+	return "", "", false
 }
@@ -0,0 +1,91 @@
+package knot
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPersistInterval is used when the persist interval is not configured
+const defaultPersistInterval = time.Second
+
+// persister coalesces the changes made to the durable fields of the devices
+// and writes them to the store on a fixed interval
+type persister struct {
+	mu       sync.Mutex
+	store    DeviceStore
+	devices  func() map[string]entities.Device
+	dirty    map[string]struct{}
+	interval time.Duration
+	log      *logrus.Entry
+}
+
+func newPersister(store DeviceStore, devices func() map[string]entities.Device, intervalInSeconds float32, log *logrus.Entry) *persister {
+	return &persister{
+		store:    store,
+		devices:  devices,
+		dirty:    make(map[string]struct{}),
+		interval: entities.Seconds(intervalInSeconds, defaultPersistInterval),
+		log:      log,
+	}
+}
+
+// mark schedules the device to be written on the next flush
+func (s *persister) mark(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty[id] = struct{}{}
+}
+
+// run flushes the changes on every interval until ctx is cancelled
+func (s *persister) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+// flush writes the devices changed since the last flush. On failure they
+// stay marked and are written again on the next one.
+func (s *persister) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.dirty) == 0 {
+		return
+	}
+	changed := make([]string, 0, len(s.dirty))
+	for id := range s.dirty {
+		changed = append(changed, id)
+	}
+
+	err := s.store.Update(s.devices(), changed)
+	if err != nil {
+		s.log.Errorln("error persisting devices: ", err)
+		return
+	}
+	s.dirty = make(map[string]struct{})
+}
+
+// flushAll writes every device to the store
+func (s *persister) flushAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.store.Save(s.devices())
+	if err != nil {
+		s.log.Errorln("error persisting devices: ", err)
+		return
+	}
+	s.dirty = make(map[string]struct{})
+}
@@ -0,0 +1,166 @@
+package knot
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/sirupsen/logrus"
+)
+
+// newBenchProtocol builds a protocol holding the given number of publishing
+// devices, persisted on the store
+func newBenchProtocol(b *testing.B, devices int, store DeviceStore) (*protocol, []string) {
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	p := &protocol{log: logrus.NewEntry(log)}
+
+	stored := make(map[string]entities.Device, devices)
+	ids := make([]string, 0, devices)
+	for i := 0; i < devices; i++ {
+		id := fmt.Sprintf("%016x", i)
+		stored[id] = entities.Device{
+			ID:    id,
+			Token: "token",
+			Name:  fmt.Sprintf("device %d", i),
+			State: entities.KnotPublishing,
+			Config: []entities.Config{{
+				SensorID: 1,
+				Schema:   entities.Schema{ValueType: entities.ValueTypeFloat, Unit: 1, TypeID: 0xFF10, Name: "flow"},
+			}},
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	p.registry = newRegistry(stored)
+	p.persister = newPersister(store, p.persistedDevices, 0, p.log)
+	p.registry.durableChanged = p.persister.mark
+	if err := store.Save(p.persistedDevices()); err != nil {
+		b.Fatal(err)
+	}
+	return p, ids
+}
+
+// benchmarkReadings updates the readings of each device in turn, calling
+// persist after every update
+func benchmarkReadings(b *testing.B, devices int, persist func(p *protocol, store DeviceStore) error) {
+	store := &yamlStore{path: filepath.Join(b.TempDir(), "device_config.yaml")}
+	p, ids := newBenchProtocol(b, devices, store)
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		device := entities.Device{
+			ID:   ids[i%len(ids)],
+			Data: []entities.Data{{SensorID: 1, Value: float64(i), TimeStamp: timestamp}},
+		}
+		if err := p.updateDevice(device); err != nil {
+			b.Fatal(err)
+		}
+		if err := persist(p, store); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkUpdateDeviceFullRewrite writes the whole device map after every
+// reading, as updateDevice did before the persister
+func BenchmarkUpdateDeviceFullRewrite(b *testing.B) {
+	for _, devices := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("devices=%d", devices), func(b *testing.B) {
+			benchmarkReadings(b, devices, func(p *protocol, store DeviceStore) error {
+				return store.Save(p.persistedDevices())
+			})
+		})
+	}
+}
+
+// BenchmarkUpdateDeviceCoalesced flushes the persister after every reading,
+// the worst case of its interval
+func BenchmarkUpdateDeviceCoalesced(b *testing.B) {
+	for _, devices := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("devices=%d", devices), func(b *testing.B) {
+			benchmarkReadings(b, devices, func(p *protocol, store DeviceStore) error {
+				p.persister.flush()
+				return nil
+			})
+		})
+	}
+}
+
+// BenchmarkFlushDurableChange renames a device before every flush, comparing
+// the stores rewriting everything with the ones writing the device changed
+func BenchmarkFlushDurableChange(b *testing.B) {
+	stores := map[string]func(dir string) DeviceStore{
+		StoreYAML: func(dir string) DeviceStore { return &yamlStore{path: filepath.Join(dir, "device_config.yaml")} },
+		StoreBolt: func(dir string) DeviceStore { return &boltStore{path: filepath.Join(dir, "devices.db")} },
+	}
+	for _, kind := range []string{StoreYAML, StoreBolt} {
+		b.Run(fmt.Sprintf("store=%s", kind), func(b *testing.B) {
+			p, ids := newBenchProtocol(b, 1000, stores[kind](b.TempDir()))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				device := entities.Device{ID: ids[i%len(ids)], Name: fmt.Sprintf("renamed %d", i)}
+				if err := p.updateDevice(device); err != nil {
+					b.Fatal(err)
+				}
+				p.persister.flush()
+			}
+		})
+	}
+}
+
+func TestPersistedFields(t *testing.T) {
+	device := entities.Device{
+		ID:     "0000000000000001",
+		Token:  "token",
+		Name:   "meter",
+		State:  entities.KnotPublishing,
+		Config: []entities.Config{{SensorID: 1, Schema: entities.Schema{ValueType: entities.ValueTypeFloat, Unit: 1, TypeID: 0x000A, Name: "pressure"}}},
+	}
+	tests := []struct {
+		name   string
+		change func(device *entities.Device)
+		marked bool
+	}{
+		{"token", func(device *entities.Device) { device.Token = "other" }, true},
+		{"name", func(device *entities.Device) { device.Name = "station" }, true},
+		{"config", func(device *entities.Device) { device.Config[0].SensorID = 2 }, true},
+		{"state", func(device *entities.Device) { device.State = entities.KnotWaitConfig }, false},
+		{"readings", func(device *entities.Device) { device.Data = []entities.Data{{SensorID: 1, Value: 1.5}} }, false},
+		{"error", func(device *entities.Device) { device.Error = "timeout" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProtocol(t, device)
+			changed, _ := p.registry.Get(device.ID)
+			tt.change(&changed)
+			p.setDevice(changed)
+
+			if _, marked := p.persister.dirty[device.ID]; marked != tt.marked {
+				t.Errorf("marked = %v, want %v", marked, tt.marked)
+			}
+		})
+	}
+}
+
+func TestPersistedDevicesRestartLifecycle(t *testing.T) {
+	device := entities.Device{
+		ID:    "0000000000000001",
+		Token: "token",
+		Name:  "meter",
+		State: entities.KnotPublishing,
+		Data:  []entities.Data{{SensorID: 1, Value: 1.5}},
+	}
+	p, _ := newTestProtocol(t, device)
+
+	persisted := p.persistedDevices()[device.ID]
+	if persisted.State != entities.KnotNew || persisted.Data != nil || persisted.Token != device.Token {
+		t.Errorf("persisted %+v, want the device as new with its token and no readings", persisted)
+	}
+}
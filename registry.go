@@ -0,0 +1,183 @@
+package knot
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// watchBuffer is how many changes a watcher can fall behind before missing them
+const watchBuffer = 64
+
+// DeviceChange reports a device added, updated or removed from the registry
+type DeviceChange struct {
+	Device  entities.Device
+	Removed bool
+}
+
+// Registry keeps the devices known by the integration. It is safe for
+// concurrent use and only hands out copies of the stored devices.
+type Registry struct {
+	mu       sync.RWMutex
+	devices  map[string]entities.Device
+	watchers map[chan DeviceChange]struct{}
+
+	// durableChanged is called when a device persisted field changes
+	durableChanged func(id string)
+}
+
+func newRegistry(devices map[string]entities.Device) *Registry {
+	r := &Registry{
+		devices:  make(map[string]entities.Device, len(devices)),
+		watchers: make(map[chan DeviceChange]struct{}),
+	}
+	for id, device := range devices {
+		r.devices[id] = copyDevice(device)
+	}
+	return r
+}
+
+// Get returns a copy of the device with the given ID
+func (r *Registry) Get(id string) (entities.Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	device, ok := r.devices[id]
+	if !ok {
+		return entities.Device{}, false
+	}
+	return copyDevice(device), true
+}
+
+// List returns a copy of every device sorted by ID
+func (r *Registry) List() []entities.Device {
+	return r.filter(func(entities.Device) bool { return true })
+}
+
+// ListByState returns a copy of the devices in the given state sorted by ID
+func (r *Registry) ListByState(state entities.State) []entities.Device {
+	return r.filter(func(device entities.Device) bool { return device.State == state })
+}
+
+// Watch returns a channel receiving every change made to the registry until
+// ctx is cancelled. Changes are dropped for watchers that fall behind.
+func (r *Registry) Watch(ctx context.Context) <-chan DeviceChange {
+	watcher := make(chan DeviceChange, watchBuffer)
+
+	r.mu.Lock()
+	r.watchers[watcher] = struct{}{}
+	r.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		r.mu.Lock()
+		delete(r.watchers, watcher)
+		close(watcher)
+		r.mu.Unlock()
+	}()
+	return watcher
+}
+
+// Snapshot returns a copy of the device map
+func (r *Registry) Snapshot() map[string]entities.Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	devices := make(map[string]entities.Device, len(r.devices))
+	for id, device := range r.devices {
+		devices[id] = copyDevice(device)
+	}
+	return devices
+}
+
+func (r *Registry) filter(match func(entities.Device) bool) []entities.Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	devices := make([]entities.Device, 0, len(r.devices))
+	for _, device := range r.devices {
+		if match(device) {
+			devices = append(devices, copyDevice(device))
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+func (r *Registry) exists(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.devices[id]
+	return ok
+}
+
+func (r *Registry) set(device entities.Device) {
+	device = copyDevice(device)
+
+	r.mu.Lock()
+	old, ok := r.devices[device.ID]
+	r.devices[device.ID] = device
+	r.notify(DeviceChange{Device: device})
+	r.mu.Unlock()
+
+	if !ok || durableChange(old, device) {
+		r.changed(device.ID)
+	}
+}
+
+func (r *Registry) remove(id string) bool {
+	r.mu.Lock()
+	device, ok := r.devices[id]
+	if ok {
+		delete(r.devices, id)
+		r.notify(DeviceChange{Device: device, Removed: true})
+	}
+	r.mu.Unlock()
+
+	if ok {
+		r.changed(id)
+	}
+	return ok
+}
+
+// changed must be called without the lock held
+func (r *Registry) changed(id string) {
+	if r.durableChanged != nil {
+		r.durableChanged(id)
+	}
+}
+
+// notify must be called with the lock held
+func (r *Registry) notify(change DeviceChange) {
+	for watcher := range r.watchers {
+		select {
+		case watcher <- DeviceChange{Device: copyDevice(change.Device), Removed: change.Removed}:
+		default:
+		}
+	}
+}
+
+// durableChange checks the fields that are persisted, readings and errors
+// change too often to be written on every update. The state is left out:
+// persistedDevices writes every device as new, since devices restart their
+// lifecycle when loaded, so a state change would rewrite the same content.
+func durableChange(old, device entities.Device) bool {
+	return old.Token != device.Token ||
+		old.Name != device.Name ||
+		!reflect.DeepEqual(old.Config, device.Config)
+}
+
+// copyDevice copies the slices of the device so callers cannot change the stored one
+func copyDevice(device entities.Device) entities.Device {
+	if device.Config != nil {
+		device.Config = append([]entities.Config(nil), device.Config...)
+	}
+	if device.Data != nil {
+		device.Data = append([]entities.Data(nil), device.Data...)
+	}
+	return device
+}
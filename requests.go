@@ -0,0 +1,97 @@
+package knot
+
+import (
+	"sync"
+
+	"github.com/luisfelipemisi/knot/integration/knot/network"
+)
+
+// requestKind identifies the Knot request a reply answers
+type requestKind string
+
+const (
+	kindRegister   requestKind = "register"
+	kindUnregister requestKind = "unregister"
+	kindAuth       requestKind = "auth"
+	kindConfig     requestKind = "config"
+)
+
+// replyKinds maps the routing key of a reply to the request it answers
+var replyKinds = map[string]requestKind{
+	network.BindingKeyRegistered:    kindRegister,
+	network.BindingKeyUnregistered:  kindUnregister,
+	network.ReplyToAuthMessages:     kindAuth,
+	network.BindingKeyUpdatedConfig: kindConfig,
+}
+
+// pendingRequest is a request sent to Knot Cloud still waiting for its reply
+type pendingRequest struct {
+	deviceID string
+	kind     requestKind
+}
+
+// pendingRequests matches replies from Knot Cloud to the requests that were
+// sent, so late and duplicated replies can be dropped
+type pendingRequests struct {
+	mu       sync.Mutex
+	requests map[string]pendingRequest
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{requests: make(map[string]pendingRequest)}
+}
+
+// add registers a new request and returns its correlation ID. Any request
+// of the same kind still pending for the device is dropped, so only the
+// reply to the last one is accepted.
+func (r *pendingRequests) add(deviceID string, kind requestKind) (string, error) {
+	correlationID, err := tokenIDGenerator()
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, request := range r.requests {
+		if request.deviceID == deviceID && request.kind == kind {
+			delete(r.requests, id)
+		}
+	}
+	r.requests[correlationID] = pendingRequest{deviceID: deviceID, kind: kind}
+	return correlationID, nil
+}
+
+// match removes the request answered by a reply and reports if it was
+// pending. Replies without a correlation ID are matched by device and kind.
+func (r *pendingRequests) match(correlationID string, deviceID string, kind requestKind) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if correlationID != "" {
+		request, ok := r.requests[correlationID]
+		if !ok || request.kind != kind || request.deviceID != deviceID {
+			return false
+		}
+		delete(r.requests, correlationID)
+		return true
+	}
+
+	for id, request := range r.requests {
+		if request.deviceID == deviceID && request.kind == kind {
+			delete(r.requests, id)
+			return true
+		}
+	}
+	return false
+}
+
+// drop forgets every request pending for the device
+func (r *pendingRequests) drop(deviceID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, request := range r.requests {
+		if request.deviceID == deviceID {
+			delete(r.requests, id)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package knot
+
+import (
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/luisfelipemisi/knot/integration/knot/network"
+	"github.com/sirupsen/logrus"
+)
+
+// testRequests returns requests pending for two devices, with the
+// correlation IDs of the register and auth of the first and the register of
+// the second
+func testRequests(t *testing.T) (*pendingRequests, [3]string) {
+	t.Helper()
+	requests := newPendingRequests()
+	var ids [3]string
+	var err error
+	for i, request := range []pendingRequest{
+		{"0000000000000001", kindRegister},
+		{"0000000000000001", kindAuth},
+		{"0000000000000002", kindRegister},
+	} {
+		ids[i], err = requests.add(request.deviceID, request.kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return requests, ids
+}
+
+func TestPendingRequestsMatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		correlationID func(ids [3]string) string
+		deviceID      string
+		kind          requestKind
+		matched       bool
+	}{
+		{"correlation ID", func(ids [3]string) string { return ids[0] }, "0000000000000001", kindRegister, true},
+		{"correlation ID of another kind", func(ids [3]string) string { return ids[1] }, "0000000000000001", kindRegister, false},
+		{"correlation ID of another device", func(ids [3]string) string { return ids[2] }, "0000000000000001", kindRegister, false},
+		{"unknown correlation ID", func(ids [3]string) string { return "unknown" }, "0000000000000001", kindRegister, false},
+		{"device and kind", func(ids [3]string) string { return "" }, "0000000000000001", kindAuth, true},
+		{"device with no request of the kind", func(ids [3]string) string { return "" }, "0000000000000002", kindAuth, false},
+		{"unknown device", func(ids [3]string) string { return "" }, "0000000000000003", kindRegister, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, ids := testRequests(t)
+			correlationID := tt.correlationID(ids)
+
+			if got := requests.match(correlationID, tt.deviceID, tt.kind); got != tt.matched {
+				t.Fatalf("match() = %v, want %v", got, tt.matched)
+			}
+			// A duplicated reply finds nothing pending
+			if tt.matched && requests.match(correlationID, tt.deviceID, tt.kind) {
+				t.Error("the same reply matched twice")
+			}
+		})
+	}
+}
+
+func TestPendingRequestsReplaceSameKind(t *testing.T) {
+	requests, ids := testRequests(t)
+
+	again, err := requests.add("0000000000000001", kindRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests.match(ids[0], "0000000000000001", kindRegister) {
+		t.Error("the replaced request still matched")
+	}
+	if !requests.match(again, "0000000000000001", kindRegister) {
+		t.Error("the last request did not match")
+	}
+	if !requests.match(ids[1], "0000000000000001", kindAuth) {
+		t.Error("the request of another kind was dropped")
+	}
+}
+
+func TestPendingRequestsDrop(t *testing.T) {
+	requests, ids := testRequests(t)
+
+	requests.drop("0000000000000001")
+	if requests.match(ids[0], "0000000000000001", kindRegister) || requests.match(ids[1], "0000000000000001", kindAuth) {
+		t.Error("a dropped request matched")
+	}
+	if !requests.match(ids[2], "0000000000000002", kindRegister) {
+		t.Error("the request of another device was dropped")
+	}
+}
+
+func TestMatchReply(t *testing.T) {
+	tests := []struct {
+		name       string
+		routingKey string
+		kind       requestKind
+		pending    bool
+		body       string
+		accepted   bool
+	}{
+		{"pending reply", network.BindingKeyRegistered, kindRegister, true, `{"id":"0000000000000001"}`, true},
+		{"reply with no request", network.BindingKeyRegistered, kindAuth, true, `{"id":"0000000000000001"}`, false},
+		{"reply to a removed device", network.BindingKeyUnregistered, kindUnregister, true, `{"id":"0000000000000001"}`, false},
+		{"unregister Knot Cloud decided", network.BindingKeyUnregistered, kindRegister, true, `{"id":"0000000000000001"}`, true},
+		{"reply of another device", network.BindingKeyUpdatedConfig, kindConfig, true, `{"id":"0000000000000002"}`, false},
+		{"invalid body", network.BindingKeyRegistered, kindRegister, true, `{`, false},
+		{"not a reply", "device.data", kindRegister, true, `{"id":"0000000000000001"}`, false},
+	}
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	for _, tt := range tests {
+		for _, withID := range []bool{true, false} {
+			requests := newPendingRequests()
+			correlationID, err := requests.add("0000000000000001", tt.kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Replies with no correlation ID fall back to the device and kind
+			if !withID {
+				correlationID = ""
+			}
+
+			message := network.InMsg{RoutingKey: tt.routingKey, CorrelationID: correlationID, Body: []byte(tt.body)}
+			if got := matchReply(message, requests, logrus.NewEntry(log)); got != tt.accepted {
+				t.Errorf("%s (correlation ID %q): matchReply() = %v, want %v", tt.name, correlationID, got, tt.accepted)
+			}
+		}
+	}
+}
+
+func TestLateReplyAfterTimeout(t *testing.T) {
+	device := entities.Device{ID: "0000000000000001", Name: "meter"}
+	p, publisher := newTestProtocol(t, device)
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+
+	if _, err := p.machine.fire(p, device, entities.KnotNew); err != nil {
+		t.Fatal(err)
+	}
+	// The timeout sends the register again
+	expire(t, p, device.ID)
+	if len(publisher.correlations) != 2 {
+		t.Fatalf("sent %v, want the register sent twice", publisher.sent)
+	}
+
+	reply := func(correlationID string) network.InMsg {
+		return network.InMsg{RoutingKey: network.BindingKeyRegistered, CorrelationID: correlationID, Body: []byte(`{"id":"0000000000000001"}`)}
+	}
+	if matchReply(reply(publisher.correlations[0]), p.requests, logrus.NewEntry(log)) {
+		t.Error("the reply to the timed out register was accepted")
+	}
+	if !matchReply(reply(publisher.correlations[1]), p.requests, logrus.NewEntry(log)) {
+		t.Error("the reply to the last register was dropped")
+	}
+}
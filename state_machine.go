@@ -0,0 +1,344 @@
+package knot
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// stateAction runs when a device enters a state or receives new readings
+// while in it. It returns the next state to move to, or an empty state to
+// stay where it is.
+type stateAction func(p *protocol, device entities.Device) (entities.Device, entities.State)
+
+// exitAction runs when a device leaves a state
+type exitAction func(p *protocol, device entities.Device) entities.Device
+
+// stateHandler declares the transitions allowed out of a state and the
+// actions bound to it
+type stateHandler struct {
+	next   []entities.State
+	entry  stateAction
+	exit   exitAction
+	update stateAction
+}
+
+// TransitionError is returned when a device is asked to move between two
+// states that are not linked in the transition table
+type TransitionError struct {
+	DeviceID string
+	From     entities.State
+	To       entities.State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("device %s: illegal transition from %q to %q", e.DeviceID, e.From, e.To)
+}
+
+// stateMachine drives the device lifecycle on the Knot network
+type stateMachine struct {
+	states map[entities.State]stateHandler
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{states: knotStates()}
+}
+
+// knotStates is the transition table of the Knot device lifecycle
+func knotStates() map[entities.State]stateHandler {
+	return map[entities.State]stateHandler{
+		// Devices loaded without a state start as new ones
+		"": {
+			next:   []entities.State{entities.KnotNew},
+			update: restart,
+		},
+		entities.KnotNew: {
+			next:   []entities.State{entities.KnotNew, entities.KnotWaitReg, entities.KnotRegistered, entities.KnotOff},
+			entry:  enterNew,
+			update: restart,
+		},
+		entities.KnotWaitReg: {
+			next:  []entities.State{entities.KnotRegistered, entities.KnotAlreadyReg, entities.KnotError, entities.KnotQuarantine, entities.KnotOff},
+			entry: requestRegister,
+			exit:  stopTimer,
+		},
+		entities.KnotRegistered: {
+			next:  []entities.State{entities.KnotWaitAuth},
+			entry: completeStep(entities.KnotWaitReg, entities.KnotWaitAuth),
+		},
+		entities.KnotWaitAuth: {
+			next:  []entities.State{entities.KnotAuth, entities.KnotForceDelete, entities.KnotError, entities.KnotQuarantine, entities.KnotOff},
+			entry: requestAuth,
+			exit:  stopTimer,
+		},
+		entities.KnotAuth: {
+			next:  []entities.State{entities.KnotWaitConfig},
+			entry: completeStep(entities.KnotWaitAuth, entities.KnotWaitConfig),
+		},
+		entities.KnotWaitConfig: {
+			next:  []entities.State{entities.KnotReady, entities.KnotForceDelete, entities.KnotError, entities.KnotQuarantine, entities.KnotOff},
+			entry: requestConfig,
+			exit:  stopTimer,
+		},
+		entities.KnotReady: {
+			next:  []entities.State{entities.KnotPublishing},
+			entry: completeStep(entities.KnotWaitConfig, entities.KnotPublishing),
+		},
+		entities.KnotPublishing: {
+			next:   []entities.State{entities.KnotAuth, entities.KnotForceDelete, entities.KnotError, entities.KnotNew},
+			entry:  enterPublishing,
+			update: publishData,
+		},
+		entities.KnotAlreadyReg: {
+			next:  []entities.State{entities.KnotWaitReg, entities.KnotWaitAuth},
+			entry: enterAlreadyRegistered,
+			exit:  clearError,
+		},
+		entities.KnotForceDelete: {
+			next:  []entities.State{entities.KnotWaitReg},
+			entry: enterForceDelete,
+			exit:  clearError,
+		},
+		entities.KnotError: {
+			next:  []entities.State{entities.KnotNew},
+			entry: enterError,
+			exit:  clearError,
+		},
+		// Devices that used up the attempts of a step wait for an operator,
+		// whether Knot Cloud did not answer or kept answering with errors
+		entities.KnotQuarantine: {
+			next:  []entities.State{entities.KnotNew},
+			entry: enterQuarantine,
+		},
+		entities.KnotOff: {
+			next: []entities.State{entities.KnotNew},
+		},
+	}
+}
+
+// canTransition checks the transition table for a path between two states
+func (m *stateMachine) canTransition(from, to entities.State) bool {
+	handler, ok := m.states[from]
+	if !ok {
+		return false
+	}
+	for _, next := range handler.next {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// fire moves the device to the given state and keeps following the states
+// returned by the entry actions until one of them settles
+func (m *stateMachine) fire(p *protocol, device entities.Device, to entities.State) (entities.Device, error) {
+	for to != "" {
+		from := device.State
+		if !m.canTransition(from, to) {
+			return device, &TransitionError{DeviceID: device.ID, From: from, To: to}
+		}
+		if exit := m.states[from].exit; exit != nil {
+			device = exit(p, device)
+		}
+		device.State = to
+		p.setDevice(device)
+
+		next := entities.State("")
+		if entry := m.states[to].entry; entry != nil {
+			device, next = entry(p, device)
+			p.setDevice(device)
+		}
+		to = next
+	}
+	return device, nil
+}
+
+// update runs the update action of the current device state
+func (m *stateMachine) update(p *protocol, device entities.Device) (entities.Device, error) {
+	handler, ok := m.states[device.State]
+	if !ok {
+		return device, &TransitionError{DeviceID: device.ID, From: device.State}
+	}
+	if handler.update == nil {
+		return device, nil
+	}
+	device, next := handler.update(p, device)
+	p.setDevice(device)
+	return m.fire(p, device, next)
+}
+
+// retry runs the entry action of the current device state again
+func (m *stateMachine) retry(p *protocol, device entities.Device) (entities.Device, error) {
+	entry := m.states[device.State].entry
+	if entry == nil {
+		return device, nil
+	}
+	device, next := entry(p, device)
+	p.setDevice(device)
+	return m.fire(p, device, next)
+}
+
+// completeStep builds an entry action that forgets the attempts spent on
+// the step answered and goes straight to the next state
+func completeStep(step entities.State, next entities.State) stateAction {
+	return func(p *protocol, device entities.Device) (entities.Device, entities.State) {
+		p.timers.reset(device.ID, step)
+		return device, next
+	}
+}
+
+// restart starts the device lifecycle again
+func restart(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	return device, entities.KnotNew
+}
+
+// enterNew registers the device, unless it already has a token. Devices
+// keep the ID they were given, a new one is generated for the ones with none.
+func enterNew(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	if device.Name == "" {
+		p.log.Errorln("Device has no name")
+		return device, entities.KnotOff
+	}
+	if device.Token != "" {
+		return device, entities.KnotRegistered
+	}
+	if device.ID != "" {
+		return device, entities.KnotWaitReg
+	}
+
+	id, err := p.generateID(device)
+	if err != nil {
+		p.log.Error(err)
+		return device, entities.KnotOff
+	}
+	device.ID = id
+	device.Token = ""
+	p.shareDevices()
+	return device, entities.KnotWaitReg
+}
+
+// requestRegister sends a register request
+func requestRegister(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	p.log.Println("send a register request")
+	correlationID, err := p.requests.add(device.ID, kindRegister)
+	if err == nil {
+		err = p.network.publisher.PublishDeviceRegister(p.userToken, &device, correlationID)
+	}
+	verifyErrors(err, p.log)
+	p.timers.start(device.ID, device.State)
+	return device, ""
+}
+
+// requestAuth sends a auth request
+func requestAuth(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	p.log.Println("send a auth request")
+	correlationID, err := p.requests.add(device.ID, kindAuth)
+	if err == nil {
+		err = p.network.publisher.PublishDeviceAuth(p.userToken, &device, correlationID)
+	}
+	verifyErrors(err, p.log)
+	p.timers.start(device.ID, device.State)
+	return device, ""
+}
+
+// requestConfig sends a updateconfig request
+func requestConfig(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	p.log.Println("send a updateconfig request")
+	correlationID, err := p.requests.add(device.ID, kindConfig)
+	if err == nil {
+		err = p.network.publisher.PublishDeviceUpdateConfig(p.userToken, &device, correlationID)
+	}
+	verifyErrors(err, p.log)
+	p.timers.start(device.ID, device.State)
+	return device, ""
+}
+
+// enterPublishing shares the ready device, listens to the commands sent to
+// it and sends any pending data
+func enterPublishing(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	p.shareDevices()
+	p.subscribeCommands(device.ID)
+	if device.Data == nil && !p.buffer.pending(device.ID) {
+		return device, ""
+	}
+	return publishData(p, device)
+}
+
+// publishData sends the new data that comes from the device to Knot Cloud,
+// after the readings buffered while the device could not publish
+func publishData(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	data := p.events.filter(device, p.validData(device), time.Now())
+	p.sendData(device, data)
+
+	device.Data = nil
+	err := p.updateDevice(device)
+	verifyErrors(err, p.log)
+	return device, ""
+}
+
+// enterAlreadyRegistered authenticates the device when it has a token,
+// otherwise registers it again with a new ID
+func enterAlreadyRegistered(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	if device.Token != "" {
+		return device, entities.KnotWaitAuth
+	}
+	return registerAgain(p, device)
+}
+
+// enterForceDelete drops the device identity and registers it again
+func enterForceDelete(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	p.log.Println("delete a device")
+	return registerAgain(p, device)
+}
+
+// registerAgain gives the device a new ID and sends a new register request
+func registerAgain(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	id, err := p.generateID(device)
+	if err != nil {
+		p.log.Error(err)
+		return device, ""
+	}
+	device.ID = id
+	device.Token = ""
+	p.shareDevices()
+	return device, entities.KnotWaitReg
+}
+
+// enterError logs the error returned by Knot Cloud, counting the ones no
+// rule knows. The device stays in this state until an operator acts on it.
+func enterError(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	cloudErr := classifyCloudError(device.Error)
+	if errors.Is(cloudErr, ErrUnknownCloudError) {
+		count := p.cloudErrors.count(device.Error)
+		p.log.Errorf("device %s: %v (seen %d times)", device.ID, cloudErr, count)
+		return device, ""
+	}
+	p.log.Errorf("device %s: %v", device.ID, cloudErr)
+	return device, ""
+}
+
+// stopTimer cancels the timeout of the request answered, the attempts of
+// the step are kept until it succeeds
+func stopTimer(p *protocol, device entities.Device) entities.Device {
+	p.timers.stop(device.ID)
+	return device
+}
+
+// enterQuarantine parks a device that used up the attempts of a step
+func enterQuarantine(p *protocol, device entities.Device) (entities.Device, entities.State) {
+	if device.Error != "" {
+		p.log.Errorf("device %s quarantined, Knot Cloud keeps answering: %s", device.ID, device.Error)
+		return device, ""
+	}
+	p.log.Errorf("device %s quarantined, no response from Knot Cloud", device.ID)
+	return device, ""
+}
+
+// clearError forgets the last error returned by Knot Cloud
+func clearError(p *protocol, device entities.Device) entities.Device {
+	device.Error = ""
+	return device
+}
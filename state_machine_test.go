@@ -0,0 +1,258 @@
+package knot
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/luisfelipemisi/knot/integration/knot/network"
+	"github.com/sirupsen/logrus"
+)
+
+// fakePublisher records the kind and device of each message sent, and the
+// configs and correlation IDs sent
+type fakePublisher struct {
+	sent         []string
+	configs      [][]entities.Config
+	correlations []string
+	err          error
+}
+
+func (f *fakePublisher) record(kind string, device *entities.Device, correlationID string) error {
+	f.sent = append(f.sent, kind+" "+device.ID)
+	f.correlations = append(f.correlations, correlationID)
+	return f.err
+}
+
+func (f *fakePublisher) PublishDeviceRegister(userToken string, device *entities.Device, correlationID string) error {
+	return f.record("register", device, correlationID)
+}
+
+func (f *fakePublisher) PublishDeviceUnregister(userToken string, device *entities.Device, correlationID string) error {
+	return f.record("unregister", device, correlationID)
+}
+
+func (f *fakePublisher) PublishDeviceAuth(userToken string, device *entities.Device, correlationID string) error {
+	return f.record("auth", device, correlationID)
+}
+
+func (f *fakePublisher) PublishDeviceUpdateConfig(userToken string, device *entities.Device, correlationID string) error {
+	f.configs = append(f.configs, device.Config)
+	return f.record("config", device, correlationID)
+}
+
+func (f *fakePublisher) PublishDeviceData(userToken string, device *entities.Device, data []entities.Data) error {
+	return f.record("data", device, "")
+}
+
+// fakeSubscriber accepts every subscription
+type fakeSubscriber struct{}
+
+func (fakeSubscriber) SubscribeToKNoTMessages(msgChan chan network.InMsg) error { return nil }
+func (fakeSubscriber) SubscribeToDeviceCommands(deviceID string) error          { return nil }
+func (fakeSubscriber) UnsubscribeFromDeviceCommands(deviceID string) error      { return nil }
+
+// newTestProtocol builds a protocol holding the given devices, talking to
+// a fake Knot Cloud
+func newTestProtocol(t *testing.T, devices ...entities.Device) (*protocol, *fakePublisher) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	log := logrus.New()
+	log.SetLevel(logrus.PanicLevel)
+	stored := make(map[string]entities.Device, len(devices))
+	for _, device := range devices {
+		stored[device.ID] = device
+	}
+
+	publisher := &fakePublisher{}
+	p := &protocol{
+		userToken:   "user token",
+		network:     &networkWrapper{publisher: publisher, subscriber: fakeSubscriber{}},
+		registry:    newRegistry(stored),
+		events:      newEventEngine(),
+		cloudErrors: newCloudErrorStats(),
+		machine:     newStateMachine(),
+		requests:    newPendingRequests(),
+		timers:      newRequestTimers(ctx, entities.KnotConfig{}),
+		bindings:    make(map[string]bool),
+		pipeDevices: make(chan map[string]entities.Device),
+		log:         logrus.NewEntry(log),
+		ctx:         ctx,
+	}
+	p.persister = newPersister(&yamlStore{path: filepath.Join(t.TempDir(), "devices.yaml")}, p.persistedDevices, 0, p.log)
+	p.registry.durableChanged = p.persister.mark
+
+	var err error
+	p.buffer, err = newReadingBuffer(entities.BufferConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		p.wg.Wait()
+		p.timers.stopAll()
+	})
+	return p, publisher
+}
+
+func TestKnotStatesTransitions(t *testing.T) {
+	machine := newStateMachine()
+	tests := []struct {
+		from, to entities.State
+		allowed  bool
+	}{
+		{"", entities.KnotNew, true},
+		{"", entities.KnotPublishing, false},
+		{entities.KnotNew, entities.KnotWaitReg, true},
+		{entities.KnotNew, entities.KnotRegistered, true},
+		{entities.KnotNew, entities.KnotPublishing, false},
+		{entities.KnotWaitReg, entities.KnotRegistered, true},
+		{entities.KnotWaitReg, entities.KnotAlreadyReg, true},
+		{entities.KnotWaitReg, entities.KnotQuarantine, true},
+		{entities.KnotWaitReg, entities.KnotWaitAuth, false},
+		{entities.KnotRegistered, entities.KnotWaitAuth, true},
+		{entities.KnotWaitAuth, entities.KnotAuth, true},
+		{entities.KnotWaitAuth, entities.KnotForceDelete, true},
+		{entities.KnotWaitAuth, entities.KnotPublishing, false},
+		{entities.KnotAuth, entities.KnotWaitConfig, true},
+		{entities.KnotWaitConfig, entities.KnotReady, true},
+		{entities.KnotWaitConfig, entities.KnotAuth, false},
+		{entities.KnotReady, entities.KnotPublishing, true},
+		{entities.KnotPublishing, entities.KnotNew, true},
+		{entities.KnotPublishing, entities.KnotWaitReg, false},
+		{entities.KnotAlreadyReg, entities.KnotWaitAuth, true},
+		{entities.KnotForceDelete, entities.KnotWaitReg, true},
+		{entities.KnotError, entities.KnotNew, true},
+		{entities.KnotError, entities.KnotPublishing, false},
+		{entities.KnotQuarantine, entities.KnotNew, true},
+		{entities.KnotOff, entities.KnotNew, true},
+		{entities.KnotOff, entities.KnotWaitReg, false},
+		{"unknown", entities.KnotNew, false},
+	}
+	for _, tt := range tests {
+		if got := machine.canTransition(tt.from, tt.to); got != tt.allowed {
+			t.Errorf("canTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.allowed)
+		}
+	}
+}
+
+func TestKnotStatesNextAreDeclared(t *testing.T) {
+	states := knotStates()
+	for from, handler := range states {
+		for _, next := range handler.next {
+			if _, ok := states[next]; !ok {
+				t.Errorf("state %q leads to undeclared state %q", from, next)
+			}
+		}
+	}
+}
+
+func TestFire(t *testing.T) {
+	config := []entities.Config{{SensorID: 1, Schema: entities.Schema{ValueType: entities.ValueTypeFloat, Unit: 1, TypeID: 0xFF10, Name: "flow"}}}
+	tests := []struct {
+		name   string
+		device entities.Device
+		state  entities.State
+		sent   []string
+	}{
+		{
+			name:   "new device registers with its ID",
+			device: entities.Device{ID: "0000000000000001", Name: "meter", Config: config},
+			state:  entities.KnotWaitReg,
+			sent:   []string{"register 0000000000000001"},
+		},
+		{
+			name:   "device with a token authenticates",
+			device: entities.Device{ID: "0000000000000002", Name: "meter", Token: "token", Config: config},
+			state:  entities.KnotWaitAuth,
+			sent:   []string{"auth 0000000000000002"},
+		},
+		{
+			name:   "device with no name is turned off",
+			device: entities.Device{ID: "0000000000000003", Config: config},
+			state:  entities.KnotOff,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, publisher := newTestProtocol(t, tt.device)
+
+			device, err := p.machine.fire(p, tt.device, entities.KnotNew)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if device.State != tt.state {
+				t.Errorf("state = %q, want %q", device.State, tt.state)
+			}
+			stored, ok := p.registry.Get(tt.device.ID)
+			if !ok || stored.State != tt.state {
+				t.Errorf("stored state = %q, want %q", stored.State, tt.state)
+			}
+			if len(publisher.sent) != len(tt.sent) {
+				t.Fatalf("sent %v, want %v", publisher.sent, tt.sent)
+			}
+			for i := range tt.sent {
+				if publisher.sent[i] != tt.sent[i] {
+					t.Errorf("sent %v, want %v", publisher.sent, tt.sent)
+				}
+			}
+		})
+	}
+}
+
+func TestFireGeneratesMissingID(t *testing.T) {
+	p, publisher := newTestProtocol(t)
+
+	device, err := p.machine.fire(p, entities.Device{Name: "meter"}, entities.KnotNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.ID == "" || device.State != entities.KnotWaitReg {
+		t.Fatalf("device = %+v, want a new ID waiting for registration", device)
+	}
+	if len(publisher.sent) != 1 || publisher.sent[0] != "register "+device.ID {
+		t.Errorf("sent %v, want a register of %s", publisher.sent, device.ID)
+	}
+}
+
+func TestFireIllegalTransition(t *testing.T) {
+	device := entities.Device{ID: "0000000000000001", Name: "meter", State: entities.KnotPublishing}
+	p, publisher := newTestProtocol(t, device)
+
+	got, err := p.machine.fire(p, device, entities.KnotWaitReg)
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) {
+		t.Fatalf("err = %v, want a TransitionError", err)
+	}
+	if transitionErr.DeviceID != device.ID || transitionErr.From != entities.KnotPublishing || transitionErr.To != entities.KnotWaitReg {
+		t.Errorf("err = %+v", transitionErr)
+	}
+	if got.State != entities.KnotPublishing {
+		t.Errorf("state = %q, want it unchanged", got.State)
+	}
+	if len(publisher.sent) != 0 {
+		t.Errorf("sent %v, want nothing", publisher.sent)
+	}
+}
+
+func TestUpdateUnknownState(t *testing.T) {
+	device := entities.Device{ID: "0000000000000001", Name: "meter", State: "unknown"}
+	p, _ := newTestProtocol(t, device)
+
+	_, err := p.machine.update(p, device)
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) || transitionErr.From != "unknown" {
+		t.Errorf("err = %v, want a TransitionError from the unknown state", err)
+	}
+}
+
+func TestTransitionErrorMessage(t *testing.T) {
+	err := &TransitionError{DeviceID: "0000000000000001", From: entities.KnotPublishing, To: entities.KnotWaitReg}
+	want := `device 0000000000000001: illegal transition from "SendData" to "waitResponseRegister"`
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
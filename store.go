@@ -0,0 +1,196 @@
+package knot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+	"github.com/luisfelipemisi/knot/integration/knot/fileutil"
+	"go.etcd.io/bbolt"
+	"gopkg.in/yaml.v2"
+)
+
+// Kinds of device store
+const (
+	StoreYAML = "yaml"
+	StoreBolt = "bolt"
+
+	defaultStorePath     = "internal/config/device_config.yaml"
+	defaultBoltStorePath = "internal/config/devices.db"
+)
+
+// DeviceStore persists the device registry
+type DeviceStore interface {
+	Load() (map[string]entities.Device, error)
+	Save(devices map[string]entities.Device) error
+	// Update writes the devices whose IDs changed, IDs missing from the
+	// map belong to removed devices
+	Update(devices map[string]entities.Device, changed []string) error
+}
+
+// NewDeviceStore constructs the device store chosen on the config
+func NewDeviceStore(conf entities.StoreConfig) (DeviceStore, error) {
+	switch conf.Kind {
+	case "", StoreYAML:
+		return &yamlStore{path: storePath(conf.Path, defaultStorePath)}, nil
+	case StoreBolt:
+		return &boltStore{path: storePath(conf.Path, defaultBoltStorePath)}, nil
+	}
+	return nil, fmt.Errorf("unknown device store %q", conf.Kind)
+}
+
+// yamlStore keeps every device on a single YAML file
+type yamlStore struct {
+	path string
+}
+
+func (s *yamlStore) Load() (map[string]entities.Device, error) {
+	devices := make(map[string]entities.Device)
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return devices, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading device store: %w", err)
+	}
+
+	err = yaml.Unmarshal(data, &devices)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding device store: %w", err)
+	}
+	return devices, nil
+}
+
+func (s *yamlStore) Save(devices map[string]entities.Device) error {
+	data, err := yaml.Marshal(&devices)
+	if err != nil {
+		return fmt.Errorf("error encoding device store: %w", err)
+	}
+	return fileutil.WriteAtomic(s.path, data)
+}
+
+// The single file is always written as a whole
+func (s *yamlStore) Update(devices map[string]entities.Device, changed []string) error {
+	return s.Save(devices)
+}
+
+// boltStore keeps each device under its ID on an embedded bbolt database,
+// every write runs on a single transaction
+type boltStore struct {
+	path string
+}
+
+var devicesBucket = []byte("devices")
+
+// boltOpenTimeout is how long to wait for another process holding the database
+const boltOpenTimeout = 5 * time.Second
+
+func (s *boltStore) Load() (map[string]entities.Device, error) {
+	devices := make(map[string]entities.Device)
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return devices, nil
+	}
+
+	err := s.run(false, func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(devicesBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(id, data []byte) error {
+			device := entities.Device{}
+			err := yaml.Unmarshal(data, &device)
+			if err != nil {
+				return fmt.Errorf("error decoding device %s: %w", id, err)
+			}
+			devices[string(id)] = device
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (s *boltStore) Save(devices map[string]entities.Device) error {
+	return s.run(true, func(tx *bbolt.Tx) error {
+		// Forget the devices removed from the registry
+		if tx.Bucket(devicesBucket) != nil {
+			if err := tx.DeleteBucket(devicesBucket); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket(devicesBucket)
+		if err != nil {
+			return err
+		}
+		for id, device := range devices {
+			if err := putDevice(bucket, id, device); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Update(devices map[string]entities.Device, changed []string) error {
+	return s.run(true, func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(devicesBucket)
+		if err != nil {
+			return err
+		}
+		for _, id := range changed {
+			device, ok := devices[id]
+			if !ok {
+				err = bucket.Delete([]byte(id))
+			} else {
+				err = putDevice(bucket, id, device)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// run opens the database for a single transaction, so it is not held
+// between the writes
+func (s *boltStore) run(writable bool, fn func(tx *bbolt.Tx) error) error {
+	err := os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return fmt.Errorf("error creating store directory: %w", err)
+	}
+	db, err := bbolt.Open(s.path, 0600, &bbolt.Options{Timeout: boltOpenTimeout, ReadOnly: !writable})
+	if err != nil {
+		return fmt.Errorf("error opening device store: %w", err)
+	}
+	defer db.Close()
+
+	if writable {
+		err = db.Update(fn)
+	} else {
+		err = db.View(fn)
+	}
+	if err != nil {
+		return fmt.Errorf("error accessing device store: %w", err)
+	}
+	return nil
+}
+
+func putDevice(bucket *bbolt.Bucket, id string, device entities.Device) error {
+	data, err := yaml.Marshal(&device)
+	if err != nil {
+		return fmt.Errorf("error encoding device %s: %w", id, err)
+	}
+	return bucket.Put([]byte(id), data)
+}
+
+func storePath(path, fallback string) string {
+	if path == "" {
+		return fallback
+	}
+	return path
+}
@@ -0,0 +1,148 @@
+package knot
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+func storedDevices() map[string]entities.Device {
+	config := []entities.Config{{
+		SensorID: 1,
+		Schema:   entities.Schema{ValueType: entities.ValueTypeFloat, Unit: 1, TypeID: 0xFF10, Name: "flow"},
+	}}
+	return map[string]entities.Device{
+		"0000000000000001": {ID: "0000000000000001", Token: "token", Name: "meter", State: entities.KnotNew, Config: config, Data: []entities.Data{}},
+		"0000000000000002": {ID: "0000000000000002", Name: "station", State: entities.KnotNew, Config: config, Data: []entities.Data{}},
+	}
+}
+
+// testStores returns a store of each kind on an empty directory
+func testStores(t *testing.T) map[string]DeviceStore {
+	return map[string]DeviceStore{
+		StoreYAML: &yamlStore{path: filepath.Join(t.TempDir(), "devices.yaml")},
+		StoreBolt: &boltStore{path: filepath.Join(t.TempDir(), "devices.db")},
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	for kind, store := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			devices := storedDevices()
+			if err := store.Save(devices); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(loaded, devices) {
+				t.Errorf("Load() = %+v, want %+v", loaded, devices)
+			}
+
+			// Rename one device and remove the other
+			changed := devices["0000000000000001"]
+			changed.Name = "renamed"
+			devices["0000000000000001"] = changed
+			delete(devices, "0000000000000002")
+			if err := store.Update(devices, []string{"0000000000000001", "0000000000000002"}); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err = store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(loaded, devices) {
+				t.Errorf("Load() after Update = %+v, want %+v", loaded, devices)
+			}
+		})
+	}
+}
+
+func TestStoreMissingFile(t *testing.T) {
+	for kind, store := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			devices, err := store.Load()
+			if err != nil || len(devices) != 0 {
+				t.Errorf("Load() = %v, %v, want no devices", devices, err)
+			}
+		})
+	}
+
+	// Loading must not create the database
+	store := &boltStore{path: filepath.Join(t.TempDir(), "devices.db")}
+	if _, err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.path); !os.IsNotExist(err) {
+		t.Errorf("Stat() = %v, want the database missing", err)
+	}
+}
+
+func TestStoreCorruptFile(t *testing.T) {
+	for kind, store := range testStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			var path string
+			switch s := store.(type) {
+			case *yamlStore:
+				path = s.path
+			case *boltStore:
+				path = s.path
+			}
+			if err := os.WriteFile(path, []byte("{{ not a store"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if devices, err := store.Load(); err == nil {
+				t.Errorf("Load() = %v, want an error", devices)
+			}
+		})
+	}
+}
+
+func TestYAMLStoreRewritesAtomically(t *testing.T) {
+	dir := t.TempDir()
+	store := &yamlStore{path: filepath.Join(dir, "devices.yaml")}
+	devices := storedDevices()
+	if err := store.Save(devices); err != nil {
+		t.Fatal(err)
+	}
+	delete(devices, "0000000000000002")
+	if err := store.Save(devices); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "devices.yaml" {
+		t.Errorf("directory holds %v, want only the store", entries)
+	}
+	loaded, err := store.Load()
+	if err != nil || !reflect.DeepEqual(loaded, devices) {
+		t.Errorf("Load() = %+v, %v, want %+v", loaded, err, devices)
+	}
+}
+
+func TestYAMLStoreCleansUpFailedRewrite(t *testing.T) {
+	dir := t.TempDir()
+	store := &yamlStore{path: filepath.Join(dir, "devices.yaml")}
+	// A directory on the store path cannot be replaced by the new file
+	if err := os.MkdirAll(filepath.Join(store.path, "busy"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(storedDevices()); err == nil {
+		t.Fatal("Save() succeeded, want an error")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		t.Errorf("directory holds %v, want the temporary file removed", entries)
+	}
+}
@@ -0,0 +1,177 @@
+package knot
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// Defaults used when a step timeout is not configured
+const (
+	defaultTimeout     = 20 * time.Second
+	defaultMaxTimeout  = 5 * time.Minute
+	defaultMultiplier  = 2
+	defaultMaxAttempts = 5
+)
+
+// requestTimeout reports a request that got no response in time
+type requestTimeout struct {
+	deviceID string
+	state    entities.State
+	seq      uint64
+}
+
+// pendingTimer is the timer of the request a device is waiting on
+type pendingTimer struct {
+	timer *time.Timer
+	state entities.State
+	seq   uint64
+}
+
+// requestTimers keeps one cancellable timer per device waiting for a
+// response and counts the attempts spent on each step. The attempts are
+// kept across the recoveries from Knot Cloud errors, until the step
+// succeeds.
+type requestTimers struct {
+	mu       sync.Mutex
+	steps    map[entities.State]entities.StepTimeout
+	timers   map[string]*pendingTimer
+	attempts map[string]map[entities.State]int
+	seq      uint64
+	timeouts chan requestTimeout
+	done     <-chan struct{}
+}
+
+func newRequestTimers(ctx context.Context, conf entities.KnotConfig) *requestTimers {
+	return &requestTimers{
+		steps: map[entities.State]entities.StepTimeout{
+			entities.KnotWaitReg:    conf.Timeouts.Register,
+			entities.KnotWaitAuth:   conf.Timeouts.Auth,
+			entities.KnotWaitConfig: conf.Timeouts.Config,
+		},
+		timers:   make(map[string]*pendingTimer),
+		attempts: make(map[string]map[entities.State]int),
+		timeouts: make(chan requestTimeout),
+		done:     ctx.Done(),
+	}
+}
+
+// start arms the timer of the request sent in the given state. Each request
+// sent on a step counts as a new attempt and waits longer.
+func (t *requestTimers) start(deviceID string, state entities.State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if pending, ok := t.timers[deviceID]; ok {
+		pending.timer.Stop()
+	}
+	attempts, ok := t.attempts[deviceID]
+	if !ok {
+		attempts = make(map[entities.State]int)
+		t.attempts[deviceID] = attempts
+	}
+	attempts[state]++
+
+	t.seq++
+	pending := &pendingTimer{state: state, seq: t.seq}
+	t.timers[deviceID] = pending
+	timeout := requestTimeout{deviceID: deviceID, state: state, seq: pending.seq}
+	pending.timer = time.AfterFunc(t.delay(state, attempts[state]), func() {
+		select {
+		case t.timeouts <- timeout:
+		case <-t.done:
+		}
+	})
+}
+
+// stop cancels the timer of the device, its attempts are kept
+func (t *requestTimers) stop(deviceID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if pending, ok := t.timers[deviceID]; ok {
+		pending.timer.Stop()
+		delete(t.timers, deviceID)
+	}
+}
+
+// reset forgets the attempts spent on a step that succeeded
+func (t *requestTimers) reset(deviceID string, state entities.State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.attempts[deviceID], state)
+}
+
+// forget cancels the timer of the device and drops its attempts
+func (t *requestTimers) forget(deviceID string) {
+	t.stop(deviceID)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.attempts, deviceID)
+}
+
+// rename keeps the attempts of a device given a new ID
+func (t *requestTimers) rename(oldID, newID string) {
+	t.stop(oldID)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if attempts, ok := t.attempts[oldID]; ok {
+		t.attempts[newID] = attempts
+		delete(t.attempts, oldID)
+	}
+}
+
+// stopAll cancels every pending timer
+func (t *requestTimers) stopAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for deviceID, pending := range t.timers {
+		pending.timer.Stop()
+		delete(t.timers, deviceID)
+	}
+}
+
+// expired checks if the timeout belongs to the request still pending, and
+// if so whether the step has attempts left
+func (t *requestTimers) expired(timeout requestTimeout) (current bool, exhausted bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending, ok := t.timers[timeout.deviceID]
+	if !ok || pending.seq != timeout.seq || pending.state != timeout.state {
+		return false, false
+	}
+	return true, t.attempts[timeout.deviceID][timeout.state] >= maxAttempts(t.steps[timeout.state])
+}
+
+// delay computes the exponential backoff of an attempt
+func (t *requestTimers) delay(state entities.State, attempt int) time.Duration {
+	step := t.steps[state]
+
+	timeout := entities.Seconds(step.TimeoutInSeconds, defaultTimeout)
+	maxTimeout := entities.Seconds(step.MaxTimeoutInSeconds, defaultMaxTimeout)
+	multiplier := float64(defaultMultiplier)
+	if step.Multiplier >= 1 {
+		multiplier = float64(step.Multiplier)
+	}
+
+	delay := time.Duration(float64(timeout) * math.Pow(multiplier, float64(attempt-1)))
+	if delay > maxTimeout || delay <= 0 {
+		return maxTimeout
+	}
+	return delay
+}
+
+func maxAttempts(step entities.StepTimeout) int {
+	if step.MaxAttempts > 0 {
+		return step.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
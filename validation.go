@@ -0,0 +1,101 @@
+package knot
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+// ReadingError reports a reading rejected because it does not match the
+// device configuration
+type ReadingError struct {
+	DeviceID string
+	SensorID int
+	Reason   string
+}
+
+func (e *ReadingError) Error() string {
+	return fmt.Sprintf("device %s sensor %d: %s", e.DeviceID, e.SensorID, e.Reason)
+}
+
+// ConfigError reports the sensor and the field of a device config that
+// does not match the KNoT schema catalog
+type ConfigError struct {
+	DeviceID string
+	SensorID int
+	Field    string
+	Err      error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("device %s sensor %d %s: %v", e.DeviceID, e.SensorID, e.Field, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// validateData splits the readings of the device into the ones matching
+// the sensor schemas and the errors of the rejected ones
+func validateData(device entities.Device) ([]entities.Data, []*ReadingError) {
+	schemas := make(map[int]entities.Schema, len(device.Config))
+	for _, config := range device.Config {
+		schemas[config.SensorID] = config.Schema
+	}
+
+	valid := make([]entities.Data, 0, len(device.Data))
+	var rejected []*ReadingError
+	for _, data := range device.Data {
+		reason := checkReading(schemas, data)
+		if reason != "" {
+			rejected = append(rejected, &ReadingError{DeviceID: device.ID, SensorID: data.SensorID, Reason: reason})
+			continue
+		}
+		valid = append(valid, data)
+	}
+	return valid, rejected
+}
+
+// checkReading returns why the reading does not match its schema, or an
+// empty string when it does
+func checkReading(schemas map[int]entities.Schema, data entities.Data) string {
+	schema, ok := schemas[data.SensorID]
+	if !ok {
+		return "sensor not configured"
+	}
+	if data.Value == nil {
+		return "missing value"
+	}
+	if !matchValueType(schema.ValueType, data.Value) {
+		return fmt.Sprintf("value %v does not match value type %d", data.Value, schema.ValueType)
+	}
+	if data.TimeStamp == nil {
+		return "missing timestamp"
+	}
+	if _, ok := parseTimestamp(data.TimeStamp); !ok {
+		return fmt.Sprintf("invalid timestamp %v", data.TimeStamp)
+	}
+	return ""
+}
+
+// matchValueType checks the Go type of the value against the schema value type
+func matchValueType(valueType int, value interface{}) bool {
+	switch valueType {
+	case entities.ValueTypeInt:
+		number, ok := entities.ToFloat(value)
+		return ok && number == math.Trunc(number)
+	case entities.ValueTypeFloat:
+		_, ok := entities.ToFloat(value)
+		return ok
+	case entities.ValueTypeBool:
+		_, ok := value.(bool)
+		return ok
+	case entities.ValueTypeRaw:
+		switch value.(type) {
+		case string, []byte:
+			return true
+		}
+	}
+	return false
+}
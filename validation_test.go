@@ -0,0 +1,79 @@
+package knot
+
+import (
+	"testing"
+
+	"github.com/luisfelipemisi/knot/integration/knot/entities"
+)
+
+func TestValidateData(t *testing.T) {
+	device := entities.Device{
+		ID: "0000000000000001",
+		Config: []entities.Config{
+			{SensorID: 1, Schema: entities.Schema{ValueType: entities.ValueTypeInt}},
+			{SensorID: 2, Schema: entities.Schema{ValueType: entities.ValueTypeFloat}},
+			{SensorID: 3, Schema: entities.Schema{ValueType: entities.ValueTypeBool}},
+			{SensorID: 4, Schema: entities.Schema{ValueType: entities.ValueTypeRaw}},
+		},
+	}
+	timestamp := "2021-03-04T05:06:07Z"
+	tests := []struct {
+		name   string
+		data   entities.Data
+		reason string
+	}{
+		{"int", entities.Data{SensorID: 1, Value: 42, TimeStamp: timestamp}, ""},
+		{"whole float as int", entities.Data{SensorID: 1, Value: 42.0, TimeStamp: timestamp}, ""},
+		{"fraction as int", entities.Data{SensorID: 1, Value: 4.2, TimeStamp: timestamp}, "value 4.2 does not match value type 1"},
+		{"float", entities.Data{SensorID: 2, Value: float32(4.2), TimeStamp: timestamp}, ""},
+		{"text as float", entities.Data{SensorID: 2, Value: "4.2", TimeStamp: timestamp}, "value 4.2 does not match value type 2"},
+		{"bool", entities.Data{SensorID: 3, Value: true, TimeStamp: "2021-03-04 05:06:07"}, ""},
+		{"number as bool", entities.Data{SensorID: 3, Value: 1, TimeStamp: timestamp}, "value 1 does not match value type 3"},
+		{"raw", entities.Data{SensorID: 4, Value: []byte("raw"), TimeStamp: timestamp}, ""},
+		{"unknown sensor", entities.Data{SensorID: 5, Value: 1, TimeStamp: timestamp}, "sensor not configured"},
+		{"no value", entities.Data{SensorID: 1, TimeStamp: timestamp}, "missing value"},
+		{"no timestamp", entities.Data{SensorID: 1, Value: 1}, "missing timestamp"},
+		{"invalid timestamp", entities.Data{SensorID: 1, Value: 1, TimeStamp: "yesterday"}, "invalid timestamp yesterday"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := device
+			device.Data = []entities.Data{tt.data}
+
+			valid, rejected := validateData(device)
+			if tt.reason == "" {
+				if len(valid) != 1 || len(rejected) != 0 {
+					t.Fatalf("valid %v, rejected %v, want the reading kept", valid, rejected)
+				}
+				return
+			}
+			if len(valid) != 0 || len(rejected) != 1 {
+				t.Fatalf("valid %v, rejected %v, want the reading rejected", valid, rejected)
+			}
+			err := rejected[0]
+			if err.DeviceID != device.ID || err.SensorID != tt.data.SensorID || err.Reason != tt.reason {
+				t.Errorf("rejected %+v, want sensor %d rejected for %q", err, tt.data.SensorID, tt.reason)
+			}
+		})
+	}
+}
+
+func TestValidateDataKeepsOrder(t *testing.T) {
+	device := entities.Device{
+		ID:     "0000000000000001",
+		Config: []entities.Config{{SensorID: 1, Schema: entities.Schema{ValueType: entities.ValueTypeInt}}},
+		Data: []entities.Data{
+			{SensorID: 1, Value: 1, TimeStamp: "2021-03-04T05:06:07Z"},
+			{SensorID: 2, Value: 2, TimeStamp: "2021-03-04T05:06:08Z"},
+			{SensorID: 1, Value: 3, TimeStamp: "2021-03-04T05:06:09Z"},
+		},
+	}
+
+	valid, rejected := validateData(device)
+	if len(valid) != 2 || valid[0].Value != 1 || valid[1].Value != 3 {
+		t.Errorf("valid %v, want the readings of sensor 1 in order", valid)
+	}
+	if len(rejected) != 1 || rejected[0].Error() != "device 0000000000000001 sensor 2: sensor not configured" {
+		t.Errorf("rejected %v, want the reading of sensor 2", rejected)
+	}
+}